@@ -0,0 +1,221 @@
+package main
+
+import (
+	"atlantis-drift-detector/config"
+	"atlantis-drift-detector/drift"
+	"atlantis-drift-detector/report"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Exit codes of run, following terraform plan -detailed-exitcode.
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitDrift   = 2
+)
+
+// runOnce executes a single drift run and exits with exitDrift when any
+// project drifted, or exitFailure when a repo could not be scanned or a
+// project errored, so that it can gate CI jobs. Unless it is a dry run or
+// plans given projects, the run replaces the stored reports and state and
+// sends notifications, like a scheduled one.
+func runOnce(args []string) int {
+	fs, configFile := flags("run")
+	once := fs.Bool("once", false, "run drift detection once and exit")
+	repoName := fs.String("repo", "", "only scan this repo, by url or name")
+	var projects stringsFlag
+	fs.Var(&projects, "project", "only plan this project, a path relative to the repo; may be repeated, requires a single repo")
+	ref := fs.String("ref", "", "scan this ref instead of the configured one, e.g. commit:<sha>; requires --repo set to the repo url")
+	output := fs.String("output", "", "print the reports to stdout in this format, one of "+strings.Join(report.Formats, ", "))
+	exitCode := fs.Bool("exit-code", true, "exit with 2 on drift and 1 on errored projects; when false only repos that could not be scanned fail the run")
+	dryRun := fs.Bool("dry-run", false, "neither store the reports and incremental state serve uses nor send notifications, as a --project run; use it in CI")
+	fs.Parse(args)
+
+	if !*once {
+		fmt.Fprintln(os.Stderr, "run: --once is required, use serve for scheduled runs")
+		return exitFailure
+	}
+	if *output != "" && !knownFormat(*output) {
+		fmt.Fprintf(os.Stderr, "run: unknown format %q, expected one of %s\n", *output, strings.Join(report.Formats, ", "))
+		return exitFailure
+	}
+
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading config: %s\n", err)
+		return exitFailure
+	}
+	if cfg.Executor.Mode == "pool" {
+		// Without a coordinator running there are no workers to plan on
+		cfg.Executor.Mode = "local"
+	}
+	if *ref != "" {
+		*repoName, err = pinRef(cfg, *repoName, *ref)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "run: %s\n", err)
+			return exitFailure
+		}
+	}
+	rt, err := prepare(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	rt.apply()
+
+	var repos []drift.Repo
+	for _, repo := range rt.repos() {
+		if *repoName == "" || repo.Config.URL == *repoName || repo.Source.Name() == *repoName {
+			repos = append(repos, repo)
+		}
+	}
+	switch {
+	case len(repos) == 0:
+		fmt.Fprintf(os.Stderr, "run: no repo matches %q\n", *repoName)
+		return exitFailure
+	case len(projects) > 0 && len(repos) > 1:
+		fmt.Fprintln(os.Stderr, "run: --project needs --repo when more than one repo is configured")
+		return exitFailure
+	case len(projects) > 0:
+		repos[0].Projects = projects
+	}
+	for i := range repos {
+		repos[i].DryRun = *dryRun
+	}
+
+	reports, err := drift.DetectDrift(context.Background(), repos)
+	code := exitOK
+	for _, repoReport := range reports {
+		for _, result := range repoReport.Results {
+			log.Infof("%s: %s", result.Project, result.Status)
+		}
+		switch {
+		case len(repoReport.Projects(report.StatusError)) > 0:
+			code = exitFailure
+		case len(repoReport.Drifted()) > 0 && code == exitOK:
+			code = exitDrift
+		}
+	}
+	if *output != "" {
+		writeErr := report.Write(os.Stdout, *output, reports)
+		if writeErr != nil {
+			log.Errorf("error printing reports: %s", writeErr)
+		}
+	}
+	if !*exitCode {
+		code = exitOK
+	}
+	if err != nil {
+		log.Errorf("error scanning repos: %s", err)
+		code = exitFailure
+	}
+	return code
+}
+
+// pinRef makes the repo with url scan ref, and returns the url it is then
+// listed under.
+func pinRef(cfg *config.Config, url, ref string) (string, error) {
+	for i, repo := range cfg.Repos {
+		if repo.URL != url {
+			continue
+		}
+		cfg.Repos[i].URL, _, _ = strings.Cut(repo.URL, "#")
+		cfg.Repos[i].Ref = ref
+		return cfg.Repos[i].URL, nil
+	}
+	return "", fmt.Errorf("--ref needs --repo set to the url of a configured repo, no repo has url %q", url)
+}
+
+func knownFormat(format string) bool {
+	for _, known := range report.Formats {
+		if format == known {
+			return true
+		}
+	}
+	return false
+}
+
+// stringsFlag is a flag that may be repeated.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// validate checks the config and reaches every repo with its credentials.
+func validate(args []string) int {
+	fs, configFile := flags("validate")
+	fs.Parse(args)
+
+	rt, err := load(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	rt.apply()
+
+	code := exitOK
+	for _, repo := range rt.repos() {
+		err := repo.Source.Check()
+		if err != nil {
+			fmt.Printf("FAIL %s: %s\n", repo.Config.URL, err)
+			code = exitFailure
+			continue
+		}
+		fmt.Printf("ok   %s\n", repo.Config.URL)
+	}
+	return code
+}
+
+// printReport prints the latest stored results of every repo.
+func printReport(args []string) int {
+	fs, configFile := flags("report")
+	format := fs.String("format", "md", "output format, one of "+strings.Join(report.Formats, ", "))
+	fs.Parse(args)
+
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading config: %s\n", err)
+		return exitFailure
+	}
+	report.UseDir(cfg.ReportsDir)
+
+	repos, err := report.Repos()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error listing reports: %s\n", err)
+		return exitFailure
+	}
+	var reports []*report.Report
+	for _, repo := range repos {
+		repoReport, err := report.Load(repo)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading report of %s: %s\n", repo, err)
+			return exitFailure
+		}
+		reports = append(reports, repoReport)
+	}
+
+	err = report.Write(os.Stdout, *format, reports)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// load reads and prepares the config file.
+func load(configFile string) (*runtime, error) {
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading config: %w", err)
+	}
+	return prepare(cfg)
+}
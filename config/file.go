@@ -0,0 +1,880 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the typed schema of the detector's YAML config file. Every field
+// has a default, so an empty file, or no file at all, is valid as long as the
+// repos and credentials are provided through environment variables.
+type Config struct {
+	// Cron is the schedule repos without their own cron are scanned on.
+	Cron string `yaml:"cron"`
+	// Concurrency is the number of plans running at the same time.
+	Concurrency int `yaml:"concurrency"`
+	// AccountConcurrency caps the plans running at the same time per
+	// account, see CredentialMapping.Account, below Concurrency.
+	AccountConcurrency map[string]int `yaml:"account_concurrency"`
+	// ParallelRepos is the number of repos of a run scanned at the same
+	// time.
+	ParallelRepos int `yaml:"parallel_repos"`
+	Port          int `yaml:"port"`
+	// APIToken, when set, is required as a bearer token by the runs API.
+	APIToken string `yaml:"api_token"`
+	// WebhookSecret verifies GitHub push webhooks, which are refused
+	// without it.
+	WebhookSecret string `yaml:"webhook_secret"`
+	ReportsDir    string `yaml:"reports_dir"`
+	StateDir      string `yaml:"state_dir"`
+	// MergeKubeconfigs merges ~/.kube/*kubeconfig* when Kubeconfig has no
+	// sources.
+	MergeKubeconfigs bool             `yaml:"merge_kubeconfigs"`
+	Kubeconfig       KubeconfigConfig `yaml:"kubeconfig"`
+
+	GitHub    GitHubConfig    `yaml:"github"`
+	GitLab    GitLabConfig    `yaml:"gitlab"`
+	Bitbucket BitbucketConfig `yaml:"bitbucket"`
+	SSH       SSHConfig       `yaml:"ssh"`
+	// CABundle is a PEM file with extra CA certificates to trust.
+	CABundle string `yaml:"ca_bundle"`
+
+	Cache       CacheConfig       `yaml:"cache"`
+	PluginCache PluginCacheConfig `yaml:"plugin_cache"`
+	Versions    VersionsConfig    `yaml:"versions"`
+	Incremental IncrementalConfig `yaml:"incremental"`
+	RefreshOnly bool              `yaml:"refresh_only"`
+	Retry       RetryConfig       `yaml:"retry"`
+
+	IgnoreFile         string `yaml:"ignore_file"`
+	SeverityFile       string `yaml:"severity_file"`
+	RedactPatternsFile string `yaml:"redact_patterns_file"`
+
+	Notifiers NotifiersConfig `yaml:"notifiers"`
+
+	LeaderElection LeaderElectionConfig `yaml:"leader_election"`
+	Executor       ExecutorConfig       `yaml:"executor"`
+
+	// Defaults apply to every repo that does not override them.
+	Defaults RepoConfig   `yaml:"defaults"`
+	Repos    []RepoConfig `yaml:"repos"`
+}
+
+type GitHubConfig struct {
+	AppID      string `yaml:"app_id"`
+	AppSlug    string `yaml:"app_slug"`
+	AppKeyFile string `yaml:"app_key_file"`
+	// InstallationID is used for every org without an entry in Installations.
+	InstallationID string `yaml:"installation_id"`
+	// Installations maps org or host/org to an installation ID.
+	Installations map[string]string `yaml:"installations"`
+	// APIURLs and GitURLs map repo hosts to GitHub Enterprise Server URLs.
+	APIURLs map[string]string `yaml:"api_urls"`
+	GitURLs map[string]string `yaml:"git_urls"`
+}
+
+type GitLabConfig struct {
+	// Tokens maps host or host/group prefixes to access tokens.
+	Tokens map[string]string `yaml:"tokens"`
+}
+
+type BitbucketConfig struct {
+	Username    string `yaml:"username"`
+	AppPassword string `yaml:"app_password"`
+}
+
+type SSHConfig struct {
+	KeyFile string `yaml:"key_file"`
+}
+
+type CacheConfig struct {
+	Dir    string `yaml:"dir"`
+	Depth  int    `yaml:"depth"`
+	Branch string `yaml:"branch"`
+}
+
+// KubeconfigConfig merges kubeconfigs into a file the detector owns, which
+// kubectl, helm and the kubernetes and helm providers use.
+type KubeconfigConfig struct {
+	// Path is where the merged kubeconfig is written.
+	Path    string             `yaml:"path"`
+	Sources []KubeconfigSource `yaml:"sources"`
+}
+
+// KubeconfigSource is one or more kubeconfig files, or a Secret.
+type KubeconfigSource struct {
+	// Path is a file, or a glob such as ~/.kube/*kubeconfig*.
+	Path string `yaml:"path"`
+	// Secret is namespace/name, or name in the detector's namespace.
+	Secret string `yaml:"secret"`
+	// Key is the key of the Secret holding the kubeconfig, config by
+	// default.
+	Key string `yaml:"key"`
+}
+
+// PluginCacheConfig keeps providers downloaded by plans for later plans.
+type PluginCacheConfig struct {
+	// Dir is shared by all plans of the detector, empty disables the
+	// cache.
+	Dir string `yaml:"dir"`
+}
+
+// VersionsConfig picks the Terraform and Terragrunt version of each
+// project.
+type VersionsConfig struct {
+	// Dir holds the installed versions as terraform/<version>/terraform and
+	// terragrunt/<version>/terragrunt. Empty plans every project with the
+	// binaries on PATH.
+	Dir string `yaml:"dir"`
+}
+
+type IncrementalConfig struct {
+	Enabled      bool `yaml:"enabled"`
+	FullRunEvery int  `yaml:"full_run_every"`
+}
+
+// RetryConfig decides which failed plans are planned again.
+type RetryConfig struct {
+	// MaxAttempts is how often a project is planned before its error is
+	// reported, 1 disables retries.
+	MaxAttempts int `yaml:"max_attempts"`
+	// Backoff is the delay before the first retry, e.g. 10s, doubled for
+	// every further retry up to MaxBackoff.
+	Backoff    string `yaml:"backoff"`
+	MaxBackoff string `yaml:"max_backoff"`
+	// Categories are the retryable errors, any of registry, backend,
+	// throttling and network.
+	Categories []string `yaml:"categories"`
+}
+
+// LeaderElectionConfig decides which replica schedules and executes runs.
+// It is only read on startup.
+type LeaderElectionConfig struct {
+	// Mode is none, kubernetes (a Lease) or file (a lock file on shared
+	// storage).
+	Mode      string `yaml:"mode"`
+	Identity  string `yaml:"identity"`
+	LeaseName string `yaml:"lease_name"`
+	Namespace string `yaml:"namespace"`
+	LockFile  string `yaml:"lock_file"`
+	// LeaseDuration is how long followers wait before taking over from a
+	// leader that stopped renewing, e.g. 15s.
+	LeaseDuration string `yaml:"lease_duration"`
+}
+
+// ExecutorConfig decides where plans run.
+type ExecutorConfig struct {
+	// Mode is local, plans run as child processes of the detector,
+	// kubernetes, plans run in Jobs, or pool, plans run on workers.
+	Mode       string                   `yaml:"mode"`
+	Kubernetes KubernetesExecutorConfig `yaml:"kubernetes"`
+	Pool       PoolConfig               `yaml:"pool"`
+}
+
+// PoolConfig describes the coordinator and workers of the pool executor.
+type PoolConfig struct {
+	// Coordinator is the URL workers lease tasks from, e.g.
+	// http://atlantis-drift-detector:8080.
+	Coordinator string `yaml:"coordinator"`
+	// LeaseDuration is how long a worker may go without heartbeat before
+	// its task is requeued, e.g. 30s.
+	LeaseDuration string `yaml:"lease_duration"`
+	// MaxAttempts is how often a task is leased before it fails.
+	MaxAttempts int `yaml:"max_attempts"`
+}
+
+// KubernetesExecutorConfig describes the Jobs plans run in. Each Job runs
+// the detector image with the same config, planning the commit being scanned.
+type KubernetesExecutorConfig struct {
+	// Scope is project, a Job per project, or repo, a Job per repo.
+	Scope     string `yaml:"scope"`
+	Namespace string `yaml:"namespace"`
+	// Image is the detector image, with terragrunt and terraform installed.
+	Image string `yaml:"image"`
+	// ServiceAccount is used by Jobs whose credential mapping names none,
+	// and by every Job in repo scope.
+	ServiceAccount string `yaml:"service_account"`
+	// ConfigMap holds the config file under ConfigKey and is mounted into
+	// every Job.
+	ConfigMap string `yaml:"config_map"`
+	ConfigKey string `yaml:"config_key"`
+	// Secrets are exposed to Jobs as environment variables.
+	Secrets   []string        `yaml:"secrets"`
+	Resources ResourcesConfig `yaml:"resources"`
+	// Timeout is how long a Job may run, e.g. 1h.
+	Timeout string `yaml:"timeout"`
+	// TTL is how long finished Jobs are kept, e.g. 1h.
+	TTL string `yaml:"ttl"`
+}
+
+// ResourcesConfig maps resource names, e.g. cpu or memory, to quantities.
+type ResourcesConfig struct {
+	Requests map[string]string `yaml:"requests"`
+	Limits   map[string]string `yaml:"limits"`
+}
+
+type NotifiersConfig struct {
+	Slack SlackConfig `yaml:"slack"`
+}
+
+type SlackConfig struct {
+	Channel     string `yaml:"channel"`
+	Token       string `yaml:"token"`
+	MinSeverity string `yaml:"min_severity"`
+	// Message is a text/template rendered with the report summary.
+	Message string `yaml:"message"`
+}
+
+// RepoConfig holds the settings of a single repo. Empty fields fall back to
+// Config.Defaults.
+type RepoConfig struct {
+	// URL is an allowlist entry, e.g. github.com/org/repo or gitlab:gitlab.com/group/repo.
+	URL string `yaml:"url"`
+	// Ref is branch:name, tag:name or commit:sha, the default branch when empty.
+	Ref  string `yaml:"ref"`
+	Cron string `yaml:"cron"`
+	// Jitter delays each scheduled run by a random duration up to this,
+	// e.g. 15m, so repos sharing a schedule do not all start at once.
+	Jitter string `yaml:"jitter"`
+	// Group names repos that are scheduled together as a single job. Repos
+	// without a group are each scheduled on their own.
+	Group string `yaml:"group"`
+	// Runner is terragrunt or terraform.
+	Runner string `yaml:"runner"`
+	// Include and Exclude are globs over project paths relative to the
+	// repo, where ** matches any number of folders.
+	Include     []string            `yaml:"include"`
+	Exclude     []string            `yaml:"exclude"`
+	Credentials []CredentialMapping `yaml:"credentials"`
+	// Notifiers names the sinks reports of this repo are sent to, all
+	// configured sinks when empty.
+	Notifiers []string `yaml:"notifiers"`
+	// Kubernetes finds Helm charts and manifests compared with the live
+	// cluster, next to the Terraform projects.
+	Kubernetes KubernetesConfig `yaml:"kubernetes"`
+}
+
+// KubernetesConfig selects the folders holding Helm charts, kustomizations
+// or plain manifests, each reported as a project.
+type KubernetesConfig struct {
+	// Include and Exclude are globs over folders relative to the repo, no
+	// folder is scanned when Include is empty.
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+	// Namespace is where Helm releases are installed, and manifests
+	// without a namespace of their own.
+	Namespace string `yaml:"namespace"`
+}
+
+// CredentialMapping sets environment variables, e.g. AWS_PROFILE, for plans
+// of projects matching any of the globs. The first matching mapping wins.
+type CredentialMapping struct {
+	Projects []string          `yaml:"projects"`
+	Env      map[string]string `yaml:"env"`
+	// ServiceAccount is the service account Jobs of these projects run as,
+	// e.g. one bound to an IAM role per environment.
+	ServiceAccount string `yaml:"service_account"`
+	// Account names the cloud account these projects plan against, which
+	// concurrency limits are kept per. It defaults to Env's AWS_PROFILE.
+	Account string `yaml:"account"`
+	// Context is the kubeconfig context Kubernetes projects are compared
+	// against, the current context when empty.
+	Context string `yaml:"context"`
+}
+
+const defaultSlackMessage = "GM team!\nDrift report for `{{.Repo}}` at `{{.Commit}}`\n" +
+	":sos: Errors: {{.Errors}}\n:no_entry: Blocked: {{.Blocked}}\n" +
+	":warning: Drifted: {{.Drifted}}{{.Breakdown}}\n:white_check_mark: No changes: {{.NoChanges}}"
+
+// Default returns the configuration used when nothing else is set, matching
+// the detector's historical behaviour.
+func Default() *Config {
+	return &Config{
+		Cron:          "30 20 * * *",
+		Concurrency:   12,
+		ParallelRepos: 4,
+		Port:          8080,
+		ReportsDir:    "csv/data",
+		StateDir:      "csv/state",
+		GitHub:        GitHubConfig{AppKeyFile: "key.pem"},
+		PluginCache:   PluginCacheConfig{Dir: "csv/plugin-cache"},
+		Kubeconfig:    KubeconfigConfig{Path: "csv/kubeconfig"},
+		Incremental:   IncrementalConfig{FullRunEvery: 7},
+		Retry: RetryConfig{
+			MaxAttempts: 3,
+			Backoff:     "10s",
+			MaxBackoff:  "2m",
+			Categories:  []string{"registry", "backend", "throttling", "network"},
+		},
+		Notifiers: NotifiersConfig{Slack: SlackConfig{Message: defaultSlackMessage}},
+		LeaderElection: LeaderElectionConfig{
+			Mode:          "none",
+			LeaseName:     "atlantis-drift-detector",
+			LeaseDuration: "15s",
+		},
+		Executor: ExecutorConfig{
+			Mode: "local",
+			Kubernetes: KubernetesExecutorConfig{
+				Scope:     "project",
+				ConfigKey: "config.yaml",
+				Timeout:   "1h",
+				TTL:       "1h",
+			},
+			Pool: PoolConfig{LeaseDuration: "30s", MaxAttempts: 3},
+		},
+		Defaults: RepoConfig{
+			Runner:     "terragrunt",
+			Include:    []string{"prod/**", "dev/**"},
+			Kubernetes: KubernetesConfig{Namespace: "default"},
+			Credentials: []CredentialMapping{
+				{Projects: []string{"prod/**"}, Env: map[string]string{"AWS_PROFILE": "prod", "TF_VAR_aws_profile": "prod"}},
+				{Projects: []string{"dev/**"}, Env: map[string]string{"AWS_PROFILE": "dev", "TF_VAR_aws_profile": "dev"}},
+			},
+		},
+	}
+}
+
+// Load reads the config file at file on top of the defaults, applies
+// environment variable overrides and validates the result. An empty file
+// name skips the file and configures the detector from the environment only.
+func Load(file string) (*Config, error) {
+	cfg := Default()
+
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading config: %w", err)
+		}
+		err = yaml.UnmarshalStrict(data, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing config %s: %w", file, err)
+		}
+	}
+
+	err := cfg.applyEnv()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MergeKubeconfigs && len(cfg.Kubeconfig.Sources) == 0 {
+		cfg.Kubeconfig.Sources = []KubeconfigSource{{Path: "~/.kube/*kubeconfig*"}}
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyEnv lets environment variables override the file. This is how
+// secrets are meant to be provided, and keeps deployments configured only
+// through the environment working.
+func (cfg *Config) applyEnv() error {
+	str := func(env string, target *string) {
+		if value, exists := os.LookupEnv(env); exists {
+			*target = value
+		}
+	}
+	boolean := func(env string, target *bool) {
+		if value, exists := os.LookupEnv(env); exists {
+			*target = value == "true"
+		}
+	}
+	var errs []string
+	integer := func(env string, target *int) {
+		if value, exists := os.LookupEnv(env); exists {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %q is not a number", env, value))
+				return
+			}
+			*target = n
+		}
+	}
+	pairs := func(env string, target *map[string]string) {
+		if value, exists := os.LookupEnv(env); exists {
+			*target = ParseKeyValues(value)
+		}
+	}
+
+	if allowlist, exists := os.LookupEnv("DRIFT_DETECTOR_ALLOWLIST"); exists {
+		for _, entry := range strings.Split(allowlist, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry != "" && !cfg.hasRepo(entry) {
+				cfg.Repos = append(cfg.Repos, RepoConfig{URL: entry})
+			}
+		}
+	}
+
+	str("DRIFT_DETECTOR_CRON", &cfg.Cron)
+	str("DRIFT_DETECTOR_API_TOKEN", &cfg.APIToken)
+	str("DRIFT_DETECTOR_WEBHOOK_SECRET", &cfg.WebhookSecret)
+	boolean("DRIFT_DETECTOR_MERGE_KUBECONFIGS", &cfg.MergeKubeconfigs)
+
+	str("DRIFT_DETECTOR_GH_APP_SLUG", &cfg.GitHub.AppSlug)
+	str("DRIFT_DETECTOR_GH_APP_ID", &cfg.GitHub.AppID)
+	str("DRIFT_DETECTOR_GH_APP_KEY_FILE", &cfg.GitHub.AppKeyFile)
+	if value, exists := os.LookupEnv("DRIFT_DETECTOR_GH_INSTALLATION_ID"); exists {
+		installations := ParseKeyValues(value)
+		cfg.GitHub.InstallationID = installations[""]
+		delete(installations, "")
+		if len(installations) > 0 {
+			cfg.GitHub.Installations = installations
+		}
+	}
+	pairs("DRIFT_DETECTOR_GH_API_URLS", &cfg.GitHub.APIURLs)
+	pairs("DRIFT_DETECTOR_GH_GIT_URLS", &cfg.GitHub.GitURLs)
+	str("DRIFT_DETECTOR_CA_BUNDLE", &cfg.CABundle)
+
+	pairs("DRIFT_DETECTOR_GITLAB_TOKENS", &cfg.GitLab.Tokens)
+	str("DRIFT_DETECTOR_BITBUCKET_USERNAME", &cfg.Bitbucket.Username)
+	str("DRIFT_DETECTOR_BITBUCKET_APP_PASSWORD", &cfg.Bitbucket.AppPassword)
+	str("DRIFT_DETECTOR_SSH_KEY_FILE", &cfg.SSH.KeyFile)
+
+	str("DRIFT_DETECTOR_CACHE_DIR", &cfg.Cache.Dir)
+	integer("DRIFT_DETECTOR_CLONE_DEPTH", &cfg.Cache.Depth)
+	str("DRIFT_DETECTOR_BRANCH", &cfg.Cache.Branch)
+
+	boolean("DRIFT_DETECTOR_INCREMENTAL", &cfg.Incremental.Enabled)
+	integer("DRIFT_DETECTOR_FULL_RUN_EVERY", &cfg.Incremental.FullRunEvery)
+	boolean("DRIFT_DETECTOR_REFRESH_ONLY", &cfg.RefreshOnly)
+
+	str("DRIFT_DETECTOR_IGNORE_FILE", &cfg.IgnoreFile)
+	str("DRIFT_DETECTOR_SEVERITY_FILE", &cfg.SeverityFile)
+	str("DRIFT_DETECTOR_REDACT_PATTERNS_FILE", &cfg.RedactPatternsFile)
+
+	str("DRIFT_DETECTOR_LEADER_ELECTION", &cfg.LeaderElection.Mode)
+	str("DRIFT_DETECTOR_LEADER_LOCK_FILE", &cfg.LeaderElection.LockFile)
+	str("DRIFT_DETECTOR_LEADER_NAMESPACE", &cfg.LeaderElection.Namespace)
+
+	// Jobs run with the config of the detector that launched them, and must
+	// not launch Jobs in turn
+	str("DRIFT_DETECTOR_EXECUTOR", &cfg.Executor.Mode)
+	str("DRIFT_DETECTOR_COORDINATOR", &cfg.Executor.Pool.Coordinator)
+
+	str("DRIFT_DETECTOR_SLACK_CHANNEL", &cfg.Notifiers.Slack.Channel)
+	str("DRIFT_DETECTOR_SLACK_TOKEN", &cfg.Notifiers.Slack.Token)
+	str("DRIFT_DETECTOR_SLACK_MIN_SEVERITY", &cfg.Notifiers.Slack.MinSeverity)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid environment:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+func (cfg *Config) hasRepo(url string) bool {
+	for _, repo := range cfg.Repos {
+		if repo.URL == url {
+			return true
+		}
+	}
+	return false
+}
+
+// Repo returns the settings of repo with every empty field filled in from
+// the defaults.
+func (cfg *Config) Repo(repo RepoConfig) RepoConfig {
+	if repo.Ref == "" {
+		repo.Ref = cfg.Defaults.Ref
+	}
+	if repo.Cron == "" {
+		repo.Cron = cfg.Defaults.Cron
+	}
+	if repo.Cron == "" {
+		repo.Cron = cfg.Cron
+	}
+	if repo.Jitter == "" {
+		repo.Jitter = cfg.Defaults.Jitter
+	}
+	if repo.Runner == "" {
+		repo.Runner = cfg.Defaults.Runner
+	}
+	if repo.Include == nil {
+		repo.Include = cfg.Defaults.Include
+	}
+	if repo.Exclude == nil {
+		repo.Exclude = cfg.Defaults.Exclude
+	}
+	if repo.Credentials == nil {
+		repo.Credentials = cfg.Defaults.Credentials
+	}
+	if repo.Notifiers == nil {
+		repo.Notifiers = cfg.Defaults.Notifiers
+	}
+	if repo.Kubernetes.Include == nil {
+		repo.Kubernetes.Include = cfg.Defaults.Kubernetes.Include
+	}
+	if repo.Kubernetes.Exclude == nil {
+		repo.Kubernetes.Exclude = cfg.Defaults.Kubernetes.Exclude
+	}
+	if repo.Kubernetes.Namespace == "" {
+		repo.Kubernetes.Namespace = cfg.Defaults.Kubernetes.Namespace
+	}
+	return repo
+}
+
+// Validate checks the whole config and reports every problem at once.
+func (cfg *Config) Validate() error {
+	var errs []string
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if _, err := cron.ParseStandard(cfg.Cron); err != nil {
+		fail("cron: invalid expression %q: %s", cfg.Cron, err)
+	}
+	if cfg.Concurrency < 1 {
+		fail("concurrency: must be at least 1, got %d", cfg.Concurrency)
+	}
+	for account, n := range cfg.AccountConcurrency {
+		if n < 1 {
+			fail("account_concurrency.%s: must be at least 1, got %d", account, n)
+		}
+	}
+	if cfg.ParallelRepos < 1 {
+		fail("parallel_repos: must be at least 1, got %d", cfg.ParallelRepos)
+	}
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		fail("port: %d is not a valid port", cfg.Port)
+	}
+	if cfg.ReportsDir == "" {
+		fail("reports_dir: must not be empty")
+	}
+	if cfg.StateDir == "" {
+		fail("state_dir: must not be empty")
+	}
+	if cfg.Cache.Depth < 0 {
+		fail("cache.depth: must not be negative, got %d", cfg.Cache.Depth)
+	}
+	if cfg.Incremental.Enabled && cfg.Incremental.FullRunEvery < 1 {
+		fail("incremental.full_run_every: must be at least 1, got %d", cfg.Incremental.FullRunEvery)
+	}
+	retry := cfg.Retry
+	if retry.MaxAttempts < 1 {
+		fail("retry.max_attempts: must be at least 1, got %d", retry.MaxAttempts)
+	}
+	backoff, err := time.ParseDuration(retry.Backoff)
+	if err != nil || backoff < 0 {
+		fail("retry.backoff: invalid duration %q", retry.Backoff)
+	}
+	if maxBackoff, err := time.ParseDuration(retry.MaxBackoff); err != nil || maxBackoff < backoff {
+		fail("retry.max_backoff: invalid duration %q, expected at least the backoff", retry.MaxBackoff)
+	}
+	for _, category := range retry.Categories {
+		switch category {
+		case "registry", "backend", "throttling", "network":
+		default:
+			fail("retry.categories: unknown category %q, expected registry, backend, throttling or network", category)
+		}
+	}
+	if level := cfg.Notifiers.Slack.MinSeverity; level != "" && !validSeverity(level) {
+		fail("notifiers.slack.min_severity: unknown severity %q", level)
+	}
+	if _, err := template.New("slack").Parse(cfg.Notifiers.Slack.Message); err != nil {
+		fail("notifiers.slack.message: %s", err)
+	}
+	election := cfg.LeaderElection
+	switch election.Mode {
+	case "none", "kubernetes":
+	case "file":
+		if election.LockFile == "" {
+			fail("leader_election.lock_file: required in file mode")
+		}
+	default:
+		fail("leader_election.mode: unknown mode %q, expected none, kubernetes or file", election.Mode)
+	}
+	if election.Mode == "kubernetes" && election.LeaseName == "" {
+		fail("leader_election.lease_name: required in kubernetes mode")
+	}
+	if duration, err := time.ParseDuration(election.LeaseDuration); err != nil || duration < time.Second {
+		fail("leader_election.lease_duration: invalid duration %q, expected at least 1s", election.LeaseDuration)
+	}
+	validateExecutor(cfg.Executor, fail)
+	for i, source := range cfg.Kubeconfig.Sources {
+		field := fmt.Sprintf("kubeconfig.sources[%d]", i)
+		switch {
+		case (source.Path == "") == (source.Secret == ""):
+			fail("%s: exactly one of path and secret must be set", field)
+		case source.Path != "":
+			if _, err := filepath.Match(source.Path, ""); err != nil {
+				fail("%s.path: invalid glob %q", field, source.Path)
+			}
+		}
+	}
+	if len(cfg.Kubeconfig.Sources) > 0 && cfg.Kubeconfig.Path == "" {
+		fail("kubeconfig.path: must not be empty")
+	}
+	for host, url := range cfg.GitHub.APIURLs {
+		if host == "" || url == "" {
+			fail("github.api_urls: invalid entry %q=%q, expected host: url", host, url)
+		}
+	}
+	for host, url := range cfg.GitHub.GitURLs {
+		if host == "" || url == "" {
+			fail("github.git_urls: invalid entry %q=%q, expected host: url", host, url)
+		}
+	}
+
+	if len(cfg.Repos) == 0 {
+		fail("repos: at least one repo is required, set repos or DRIFT_DETECTOR_ALLOWLIST")
+	}
+	validateRepo("defaults", cfg.Defaults, fail)
+	if cfg.Defaults.Group != "" {
+		fail("defaults.group: repos cannot share a default group")
+	}
+	seen := make(map[string]bool)
+	groups := make(map[string]RepoConfig)
+	for i, repo := range cfg.Repos {
+		field := fmt.Sprintf("repos[%d]", i)
+		if repo.URL == "" {
+			fail("%s.url: must not be empty", field)
+		} else if seen[repo.URL] {
+			fail("%s.url: %s is listed twice", field, repo.URL)
+		}
+		seen[repo.URL] = true
+		validateRepo(field, repo, fail)
+
+		if repo.Group != "" {
+			merged := cfg.Repo(repo)
+			if first, ok := groups[repo.Group]; !ok {
+				groups[repo.Group] = merged
+			} else if first.Cron != merged.Cron || first.Jitter != merged.Jitter {
+				fail("%s: repos of group %s must share cron and jitter, %s does not match %s", field, repo.Group, repo.URL, first.URL)
+			}
+		}
+
+		if !isGitHub(repo.URL) {
+			continue
+		}
+		if cfg.GitHub.AppID == "" {
+			fail("%s: github app_id is required for %s, set github.app_id or DRIFT_DETECTOR_GH_APP_ID", field, repo.URL)
+		}
+		if cfg.GitHub.InstallationID == "" && len(cfg.GitHub.Installations) == 0 {
+			fail("%s: a github installation is required for %s, set github.installation_id or DRIFT_DETECTOR_GH_INSTALLATION_ID", field, repo.URL)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+func validateExecutor(executor ExecutorConfig, fail func(string, ...interface{})) {
+	pool := executor.Pool
+	if duration, err := time.ParseDuration(pool.LeaseDuration); err != nil || duration < time.Second {
+		fail("executor.pool.lease_duration: invalid duration %q, expected at least 1s", pool.LeaseDuration)
+	}
+	if pool.MaxAttempts < 1 {
+		fail("executor.pool.max_attempts: must be at least 1, got %d", pool.MaxAttempts)
+	}
+
+	switch executor.Mode {
+	case "local", "pool":
+		return
+	case "kubernetes":
+	default:
+		fail("executor.mode: unknown mode %q, expected local, kubernetes or pool", executor.Mode)
+		return
+	}
+	k8s := executor.Kubernetes
+	switch k8s.Scope {
+	case "project", "repo":
+	default:
+		fail("executor.kubernetes.scope: unknown scope %q, expected project or repo", k8s.Scope)
+	}
+	if k8s.Image == "" {
+		fail("executor.kubernetes.image: required in kubernetes mode")
+	}
+	if k8s.ConfigMap != "" && k8s.ConfigKey == "" {
+		fail("executor.kubernetes.config_key: required with a config_map")
+	}
+	if timeout, err := time.ParseDuration(k8s.Timeout); err != nil || timeout < time.Second {
+		fail("executor.kubernetes.timeout: invalid duration %q, expected at least 1s", k8s.Timeout)
+	}
+	if ttl, err := time.ParseDuration(k8s.TTL); err != nil || ttl < 0 {
+		fail("executor.kubernetes.ttl: invalid duration %q", k8s.TTL)
+	}
+}
+
+func validateRepo(field string, repo RepoConfig, fail func(string, ...interface{})) {
+	if repo.Cron != "" {
+		if _, err := cron.ParseStandard(repo.Cron); err != nil {
+			fail("%s.cron: invalid expression %q: %s", field, repo.Cron, err)
+		}
+	}
+	if repo.Jitter != "" {
+		if jitter, err := time.ParseDuration(repo.Jitter); err != nil || jitter < 0 {
+			fail("%s.jitter: invalid duration %q", field, repo.Jitter)
+		}
+	}
+	switch repo.Runner {
+	case "", "terragrunt", "terraform":
+	default:
+		fail("%s.runner: unknown runner %q, expected terragrunt or terraform", field, repo.Runner)
+	}
+	if repo.Ref != "" && strings.Contains(repo.URL, "#") {
+		fail("%s: ref is set both in url and ref", field)
+	}
+	globs := append(append([]string{}, repo.Include...), repo.Exclude...)
+	globs = append(append(globs, repo.Kubernetes.Include...), repo.Kubernetes.Exclude...)
+	for _, mapping := range repo.Credentials {
+		globs = append(globs, mapping.Projects...)
+	}
+	for _, glob := range globs {
+		if _, err := path.Match(strings.ReplaceAll(glob, "**", "*"), ""); err != nil {
+			fail("%s: invalid glob %q", field, glob)
+		}
+	}
+	for _, notifier := range repo.Notifiers {
+		if notifier != "slack" {
+			fail("%s.notifiers: unknown notifier %q", field, notifier)
+		}
+	}
+}
+
+// isGitHub reports whether the allowlist entry url is fetched from GitHub,
+// the default kind.
+func isGitHub(url string) bool {
+	kind, _, found := strings.Cut(url, ":")
+	if !found {
+		return true
+	}
+	switch kind {
+	case "gitlab", "bitbucket", "ssh", "local":
+		return false
+	}
+	return true
+}
+
+func validSeverity(level string) bool {
+	switch level {
+	case "low", "medium", "high", "critical":
+		return true
+	}
+	return false
+}
+
+// ProjectEnv returns the environment variables of the first credential
+// mapping matching project, a path relative to the repo.
+func (repo RepoConfig) ProjectEnv(project string) map[string]string {
+	return repo.credentials(project).Env
+}
+
+// ProjectServiceAccount returns the service account of the first credential
+// mapping matching project, empty when it names none.
+func (repo RepoConfig) ProjectServiceAccount(project string) string {
+	return repo.credentials(project).ServiceAccount
+}
+
+// ProjectAccount returns the account of the first credential mapping
+// matching project, empty when no mapping matches.
+func (repo RepoConfig) ProjectAccount(project string) string {
+	mapping := repo.credentials(project)
+	if mapping.Account != "" {
+		return mapping.Account
+	}
+	return mapping.Env["AWS_PROFILE"]
+}
+
+// ProjectContext returns the kubeconfig context of the first credential
+// mapping matching project, empty when it names none.
+func (repo RepoConfig) ProjectContext(project string) string {
+	return repo.credentials(project).Context
+}
+
+func (repo RepoConfig) credentials(project string) CredentialMapping {
+	for _, mapping := range repo.Credentials {
+		for _, glob := range mapping.Projects {
+			if MatchGlob(glob, project) {
+				return mapping
+			}
+		}
+	}
+	return CredentialMapping{}
+}
+
+// JitterDuration returns the parsed Jitter, zero when unset.
+func (repo RepoConfig) JitterDuration() time.Duration {
+	jitter, _ := time.ParseDuration(repo.Jitter)
+	return jitter
+}
+
+// Job is the name repo is scheduled under, its group or its url.
+func (repo RepoConfig) Job() string {
+	if repo.Group != "" {
+		return repo.Group
+	}
+	return repo.URL
+}
+
+// Selects reports whether project, a path relative to the repo, matches the
+// include globs, or all projects when there are none, and no exclude glob.
+func (repo RepoConfig) Selects(project string) bool {
+	for _, glob := range repo.Exclude {
+		if MatchGlob(glob, project) {
+			return false
+		}
+	}
+	if len(repo.Include) == 0 {
+		return true
+	}
+	for _, glob := range repo.Include {
+		if MatchGlob(glob, project) {
+			return true
+		}
+	}
+	return false
+}
+
+// Selects reports whether the folder project holds Kubernetes resources
+// to compare, matching an include glob and no exclude glob.
+func (k KubernetesConfig) Selects(project string) bool {
+	for _, glob := range k.Exclude {
+		if MatchGlob(glob, project) {
+			return false
+		}
+	}
+	for _, glob := range k.Include {
+		if MatchGlob(glob, project) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchGlob matches a slash separated path against pattern, where ** matches
+// any number of path segments and every other segment follows path.Match.
+func MatchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Watch polls file every interval and calls onChange with every new version
+// of it that loads and validates. Versions that do not are passed to onError
+// and otherwise ignored, so the caller keeps its last good config. Polling
+// the content, rather than watching for events, follows the symlink swaps
+// Kubernetes uses to update mounted ConfigMaps.
+func Watch(file string, interval time.Duration, onChange func(*Config), onError func(error)) {
+	last, err := os.ReadFile(file)
+	if err != nil {
+		log.Warnf("error reading config %s: %v", file, err)
+	}
+
+	for range time.Tick(interval) {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			// A ConfigMap update can briefly leave the file missing
+			log.Debugf("error reading config %s: %v", file, err)
+			continue
+		}
+		if bytes.Equal(data, last) {
+			continue
+		}
+		last = data
+
+		log.Infof("config %s changed, reloading", file)
+		cfg, err := Load(file)
+		if err != nil {
+			onError(err)
+			continue
+		}
+		onChange(cfg)
+	}
+}
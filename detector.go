@@ -0,0 +1,529 @@
+package main
+
+import (
+	"atlantis-drift-detector/config"
+	"atlantis-drift-detector/drift"
+	"atlantis-drift-detector/exporter"
+	"atlantis-drift-detector/ghapp"
+	"atlantis-drift-detector/k8sjob"
+	"atlantis-drift-detector/kubeconfig"
+	"atlantis-drift-detector/notifier"
+	"atlantis-drift-detector/pod"
+	"atlantis-drift-detector/pool"
+	"atlantis-drift-detector/queue"
+	"atlantis-drift-detector/redact"
+	"atlantis-drift-detector/report"
+	"atlantis-drift-detector/server"
+	"atlantis-drift-detector/severity"
+	"atlantis-drift-detector/source"
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// coordinator hands out tasks to workers when plans run on a pool. It
+// outlives config reloads, which would otherwise lose leased tasks.
+var coordinator = pool.New()
+
+// runtime is everything built from a config. It is prepared completely
+// before any of it is applied, so a config that fails half way leaves the
+// last good one in place.
+type runtime struct {
+	cfg            *config.Config
+	httpClient     *http.Client
+	redactPatterns redact.Patterns
+	severityRules  *severity.Rules
+	slack          notifier.Sink
+	// executor runs plans outside of the detector, nil to run them locally.
+	executor drift.Executor
+	creds    *source.Credentials
+	// kubeconfig is the merge of the kubeconfig sources, nil without any.
+	kubeconfig *clientcmdapi.Config
+	// jobs are the scheduled groups of repos, in config order.
+	jobs []*job
+}
+
+// job is a repo, or a group of repos, scanned on its own schedule.
+type job struct {
+	name   string
+	cron   string
+	jitter time.Duration
+	repos  []drift.Repo
+}
+
+// repos returns the repos of every job.
+func (rt *runtime) repos() []drift.Repo {
+	var repos []drift.Repo
+	for _, j := range rt.jobs {
+		repos = append(repos, j.repos...)
+	}
+	return repos
+}
+
+// prepare builds the runtime of cfg without changing any global state.
+func prepare(cfg *config.Config) (*runtime, error) {
+	rt := &runtime{cfg: cfg}
+	var err error
+
+	// Resolve GitHub endpoints, github.com or Enterprise Server, per repo host
+	ghEndpoints := ghapp.NewEndpoints(cfg.GitHub.APIURLs, cfg.GitHub.GitURLs)
+	rt.httpClient, err = ghapp.NewHTTPClient(cfg.CABundle)
+	if err != nil {
+		return nil, fmt.Errorf("error configuring http client: %w", err)
+	}
+
+	// Extra patterns scrubbed from plan output before it is stored or sent
+	rt.redactPatterns, err = redact.LoadPatterns(cfg.RedactPatternsFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading redaction patterns: %w", err)
+	}
+
+	// Rate drifted projects and decide which notifications fire
+	rt.severityRules, err = severity.Load(cfg.SeverityFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading severity rules: %w", err)
+	}
+
+	slack := cfg.Notifiers.Slack
+	if slack.Channel != "" && slack.Token != "" {
+		rt.slack, err = notifier.NewSlackSink(slack.Channel, slack.Token, slack.Message)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring slack: %w", err)
+		}
+	}
+
+	// Plans run in Kubernetes Jobs, or on workers, rather than as child
+	// processes
+	switch cfg.Executor.Mode {
+	case "pool":
+		rt.executor = coordinator
+	case "kubernetes":
+		opts, err := k8sjob.NewOptions(cfg.Executor.Kubernetes)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring kubernetes executor: %w", err)
+		}
+		client, err := k8sjob.NewInClusterClient()
+		if err != nil {
+			return nil, fmt.Errorf("error configuring kubernetes executor: %w", err)
+		}
+		rt.executor = k8sjob.New(client, opts)
+	}
+
+	// Kubeconfigs are merged up front, so that conflicts reject the config
+	if len(cfg.Kubeconfig.Sources) > 0 {
+		rt.kubeconfig, err = mergeKubeconfigs(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("error merging kubeconfigs: %w", err)
+		}
+	}
+
+	// Credentials for every repository source. A single GitHub token provider
+	// is shared by everything that talks to GitHub.
+	rt.creds = &source.Credentials{
+		GitHubTokens:         ghapp.NewTokenProvider(cfg.GitHub.AppID, cfg.GitHub.AppKeyFile, ghEndpoints, rt.httpClient),
+		GitHubInstallations:  ghapp.NewInstallations(cfg.GitHub.InstallationID, cfg.GitHub.Installations),
+		GitHubEndpoints:      ghEndpoints,
+		GitLabTokens:         cfg.GitLab.Tokens,
+		BitbucketUsername:    cfg.Bitbucket.Username,
+		BitbucketAppPassword: cfg.Bitbucket.AppPassword,
+		SSHKeyFile:           cfg.SSH.KeyFile,
+	}
+
+	// Each repo selects the source it is fetched from and is scheduled on
+	// its own, or with the rest of its group
+	jobs := make(map[string]*job)
+	names := make(map[string]string)
+	for _, repoConfig := range cfg.Repos {
+		repoConfig = cfg.Repo(repoConfig)
+		entry := repoConfig.URL
+		if repoConfig.Ref != "" {
+			entry += "#" + repoConfig.Ref
+		}
+		src, err := source.Parse(entry, rt.creds)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing repo %s: %w", repoConfig.URL, err)
+		}
+		// Reports and incremental state are stored under the repo's name
+		if other, ok := names[src.Name()]; ok {
+			return nil, fmt.Errorf("repos %s and %s are both named %s, their reports would overwrite each other", other, repoConfig.URL, src.Name())
+		}
+		names[src.Name()] = repoConfig.URL
+		j, ok := jobs[repoConfig.Job()]
+		if !ok {
+			j = &job{name: repoConfig.Job(), cron: repoConfig.Cron, jitter: repoConfig.JitterDuration()}
+			jobs[j.name] = j
+			rt.jobs = append(rt.jobs, j)
+		}
+		j.repos = append(j.repos, drift.Repo{Source: src, Config: repoConfig})
+	}
+
+	return rt, nil
+}
+
+// mergeKubeconfigs merges the kubeconfig sources of cfg and checks that the
+// contexts projects are mapped to exist.
+func mergeKubeconfigs(cfg *config.Config) (*clientcmdapi.Config, error) {
+	var secrets kubeconfig.Secrets
+	for _, source := range cfg.Kubeconfig.Sources {
+		if source.Secret == "" {
+			continue
+		}
+		client, err := k8sjob.NewInClusterClient()
+		if err != nil {
+			return nil, err
+		}
+		namespace, _ := pod.Namespace()
+		secrets = kubeconfig.Secrets{Client: client, Namespace: namespace}
+		break
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	merged, err := kubeconfig.Merge(ctx, cfg.Kubeconfig.Sources, secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, repo := range append([]config.RepoConfig{cfg.Defaults}, cfg.Repos...) {
+		for _, mapping := range cfg.Repo(repo).Credentials {
+			if _, ok := merged.Contexts[mapping.Context]; mapping.Context != "" && !ok {
+				return nil, fmt.Errorf("context %q of projects %v is in none of the kubeconfigs", mapping.Context, mapping.Projects)
+			}
+		}
+	}
+	return merged, nil
+}
+
+// apply makes rt the settings drift runs use.
+func (rt *runtime) apply() {
+	cfg := rt.cfg
+
+	report.UseDir(cfg.ReportsDir)
+	drift.UseStateDir(cfg.StateDir)
+	drift.UseConcurrency(cfg.Concurrency)
+	drift.UseLimits(cfg.Concurrency, cfg.AccountConcurrency)
+	drift.UseParallelRepos(cfg.ParallelRepos)
+	drift.UseExecutor(rt.executor)
+	leaseDuration, _ := time.ParseDuration(cfg.Executor.Pool.LeaseDuration)
+	coordinator.UseLease(leaseDuration, cfg.Executor.Pool.MaxAttempts)
+	source.UseHTTPClient(rt.httpClient)
+
+	// Keep clones between runs when a cache directory is configured
+	source.UseCache(cfg.Cache.Dir, cfg.Cache.Depth, cfg.Cache.Branch)
+	// Share providers between plans instead of downloading them per project
+	drift.UsePluginCache(cfg.PluginCache.Dir)
+	drift.UseVersionsDir(cfg.Versions.Dir)
+
+	// Point kubectl, helm and plans at the merged kubeconfig
+	kubeconfigPath := ""
+	if rt.kubeconfig != nil {
+		err := kubeconfig.Write(rt.kubeconfig, cfg.Kubeconfig.Path)
+		if err != nil {
+			log.Errorf("error writing kubeconfig %s, keeping the previous one: %s", cfg.Kubeconfig.Path, err)
+		}
+		kubeconfigPath = cfg.Kubeconfig.Path
+	}
+	drift.UseKubeconfig(kubeconfigPath)
+
+	// Global ignore rules, applied on top of each repo's .drift-ignore.yaml
+	drift.UseIgnoreFile(cfg.IgnoreFile)
+	redact.UsePatterns(rt.redactPatterns)
+
+	// Tell out-of-band drift from unapplied code with refresh-only plans
+	drift.UseRefreshOnly(cfg.RefreshOnly)
+
+	// Plan again after transient errors, e.g. registry timeouts
+	backoff, _ := time.ParseDuration(cfg.Retry.Backoff)
+	maxBackoff, _ := time.ParseDuration(cfg.Retry.MaxBackoff)
+	drift.UseRetry(cfg.Retry.MaxAttempts, backoff, maxBackoff, cfg.Retry.Categories)
+	drift.UseSeverityRules(rt.severityRules)
+
+	server.UseAPIAuth(cfg.APIToken, cfg.WebhookSecret)
+
+	notifier.Reset()
+	if rt.slack != nil {
+		notifier.Register(rt.slack, cfg.Notifiers.Slack.MinSeverity)
+	} else {
+		log.Info("slack channel or token not set, slack notifications are disabled")
+	}
+
+	// Only re-plan affected projects between periodic full runs
+	fullRunEvery := 0
+	if cfg.Incremental.Enabled {
+		fullRunEvery = cfg.Incremental.FullRunEvery
+	}
+	drift.UseIncremental(fullRunEvery)
+}
+
+// detector schedules a cron entry per job, feeds runs through its queue and
+// swaps in new configs between runs.
+type detector struct {
+	mu sync.Mutex
+	// leading is set while this replica is the one running drift runs.
+	leading bool
+	// stopped is closed when this replica stops leading, which ends the
+	// jitter scheduled runs wait out.
+	stopped chan struct{}
+	// active counts the runs in progress.
+	active  int
+	queue   *queue.Queue
+	current *runtime
+	// pending is a config that arrived during a run, applied once no job
+	// is running.
+	pending *runtime
+	cron    *cron.Cron
+	entries map[string]entry
+}
+
+// entry is a scheduled job.
+type entry struct {
+	id     cron.EntryID
+	cron   string
+	jitter time.Duration
+}
+
+func newDetector(rt *runtime) *detector {
+	d := &detector{cron: cron.New(), entries: make(map[string]entry)}
+	d.queue = queue.New(d.resolve, d.execute)
+	d.activate(rt)
+	return d
+}
+
+// update applies rt now, or once the runs in progress have ended.
+func (d *detector) update(rt *runtime) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if rt.cfg.Port != d.current.cfg.Port {
+		log.Warnf("the server port changed to %d, it is only applied on restart", rt.cfg.Port)
+	}
+	if d.active > 0 {
+		log.Info("drift run in progress, the new config is applied when it ends")
+		d.pending = rt
+		return
+	}
+	d.activate(rt)
+}
+
+// activate applies rt and reschedules the jobs that appeared, disappeared or
+// changed schedule. The caller holds d.mu, or has d to itself.
+func (d *detector) activate(rt *runtime) {
+	rt.apply()
+	d.current = rt
+
+	wanted := make(map[string]*job, len(rt.jobs))
+	for _, j := range rt.jobs {
+		wanted[j.name] = j
+	}
+	for name, e := range d.entries {
+		if j, ok := wanted[name]; !ok || j.cron != e.cron || j.jitter != e.jitter {
+			d.cron.Remove(e.id)
+			delete(d.entries, name)
+			log.Infof("unscheduled drift runs of %s at %q", name, e.cron)
+		}
+	}
+	for _, j := range rt.jobs {
+		if _, ok := d.entries[j.name]; ok {
+			continue
+		}
+		name := j.name
+		id, err := d.cron.AddFunc(j.cron, func() { d.trigger(name) })
+		if err != nil {
+			log.Warnf("Error scheduling cron job: %s", err)
+			continue
+		}
+		d.entries[name] = entry{id: id, cron: j.cron, jitter: j.jitter}
+		log.Infof("scheduled drift runs of %s at %q", name, j.cron)
+	}
+}
+
+// trigger queues a scheduled run of the job called name.
+func (d *detector) trigger(name string) {
+	d.mu.Lock()
+	var jitter time.Duration
+	for _, j := range d.current.jobs {
+		if j.name == name {
+			jitter = j.jitter
+		}
+	}
+	stopped := d.stopped
+	d.mu.Unlock()
+
+	// Spread out jobs sharing a schedule
+	if jitter > 0 {
+		delay := time.Duration(rand.Int63n(int64(jitter)))
+		log.Debugf("delaying drift run of %s by %s", name, delay)
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-stopped:
+			log.Debugf("dropping drift run of %s, no longer leading", name)
+			return
+		}
+	}
+
+	_, _, err := d.queue.Submit(queue.Request{Repo: name, Trigger: queue.TriggerCron})
+	if err != nil {
+		log.Warnf("error queueing drift run of %s: %s", name, err)
+	}
+}
+
+// find returns the repos req.Repo names, by job, url or repo name, and the
+// jobs they belong to. An empty name selects every repo. The caller holds
+// d.mu.
+func (d *detector) find(name string) (repos []drift.Repo, jobs []string) {
+	for _, j := range d.current.jobs {
+		matched := false
+		for _, repo := range j.repos {
+			if name == "" || name == j.name || name == repo.Config.URL || name == repo.Source.Name() {
+				repos = append(repos, repo)
+				matched = true
+			}
+		}
+		if matched {
+			jobs = append(jobs, j.name)
+		}
+	}
+	return repos, jobs
+}
+
+// resolve checks that req names configured repos and returns the jobs its
+// run locks, so runs of the same job never overlap.
+func (d *detector) resolve(req *queue.Request) ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.leading {
+		return nil, queue.ErrUnavailable
+	}
+	repos, jobs := d.find(req.Repo)
+	switch {
+	case len(repos) == 0:
+		return nil, fmt.Errorf("no repo matches %q", req.Repo)
+	case req.Project != "" && len(repos) > 1:
+		return nil, fmt.Errorf("project %s needs a single repo", req.Project)
+	case len(repos) == 1 && req.Repo != "":
+		req.Repo = repos[0].Config.URL
+	}
+
+	// Pushes only matter for the branch that is scanned
+	if req.Branch != "" {
+		for _, repo := range repos {
+			if scanned := d.scannedBranch(repo, req.DefaultBranch); scanned != req.Branch {
+				return nil, fmt.Errorf("%s scans %q, not %s", repo.Config.URL, scanned, req.Branch)
+			}
+		}
+	}
+	return jobs, nil
+}
+
+// scannedBranch returns the branch repo is scanned at, defaultBranch when it
+// follows the remote default, or empty for tags and commits. The caller
+// holds d.mu.
+func (d *detector) scannedBranch(repo drift.Repo, defaultBranch string) string {
+	ref, err := source.ParseRef(repo.Config.Ref)
+	switch {
+	case err != nil:
+		return ""
+	case ref.Kind == "" && d.current.cfg.Cache.Branch != "":
+		return d.current.cfg.Cache.Branch
+	case ref.Kind == "":
+		return defaultBranch
+	case ref.Kind == "branch":
+		return ref.Name
+	default:
+		return ""
+	}
+}
+
+// execute carries out a queued run with the config current when it starts.
+func (d *detector) execute(ctx context.Context, run *queue.Run) (map[string]string, error) {
+	d.mu.Lock()
+	repos, _ := d.find(run.Repo)
+	if len(repos) == 0 {
+		d.mu.Unlock()
+		return nil, fmt.Errorf("no repo matches %q anymore", run.Repo)
+	}
+	d.active++
+	if run.Project != "" {
+		for i := range repos {
+			repos[i].Projects = []string{run.Project}
+		}
+	}
+	d.mu.Unlock()
+
+	log.Debugf("running DetectDrift function for run %s", run.ID)
+	reports, err := drift.DetectDrift(ctx, repos)
+
+	d.mu.Lock()
+	d.active--
+	if d.pending != nil && d.active == 0 {
+		d.activate(d.pending)
+		d.pending = nil
+	}
+	d.mu.Unlock()
+
+	metricsErr := exporter.UpdateMetricsFromCSV(report.Dir)
+	if metricsErr != nil {
+		log.Warnf("error reading CSV: %s", metricsErr)
+	}
+
+	projects := make(map[string]string)
+	for _, repoReport := range reports {
+		for _, result := range repoReport.Results {
+			projects[result.Project] = result.Status
+		}
+	}
+	return projects, err
+}
+
+// lead starts scheduling runs once this replica became the leader.
+func (d *detector) lead(ctx context.Context) {
+	d.mu.Lock()
+	d.leading = true
+	d.stopped = make(chan struct{})
+	d.mu.Unlock()
+	coordinator.Open()
+	d.cron.Start()
+}
+
+// follow stops scheduling and cancels the runs of this replica once it is
+// no longer the leader, the new leader takes over. Runs waiting out their
+// jitter are dropped.
+func (d *detector) follow() {
+	d.mu.Lock()
+	d.leading = false
+	if d.stopped != nil {
+		close(d.stopped)
+		d.stopped = nil
+	}
+	d.mu.Unlock()
+	d.queue.CancelAll()
+	<-d.cron.Stop().Done()
+	coordinator.Close()
+}
+
+// reload is called with every new valid version of the config file.
+func (d *detector) reload(cfg *config.Config) {
+	rt, err := prepare(cfg)
+	if err != nil {
+		d.reject(err)
+		return
+	}
+	d.update(rt)
+	log.Info("config reloaded")
+}
+
+// reject keeps the last good config when a new version is invalid.
+func (d *detector) reject(err error) {
+	exporter.CountConfigReloadError()
+	log.Errorf("rejected config, keeping the last good one: %s", err)
+}
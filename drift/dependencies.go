@@ -0,0 +1,113 @@
+package drift
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// dependencyPattern matches dependency "name" { config_path = "..." } blocks.
+	dependencyPattern = regexp.MustCompile(`(?s)\bdependency\s+"[^"]*"\s*\{[^}]*?\bconfig_path\s*=\s*"([^"]+)"`)
+	// dependenciesPattern matches dependencies { paths = [...] } blocks.
+	dependenciesPattern = regexp.MustCompile(`(?s)\bdependencies\s*\{[^}]*?\bpaths\s*=\s*\[([^\]]*)\]`)
+	quotedPattern       = regexp.MustCompile(`"([^"]+)"`)
+)
+
+// projectDependencies parses the dependency and dependencies blocks of every
+// project's terragrunt.hcl and returns, for each project, the upstream
+// projects it depends on. Paths are relative to root, and dependencies on
+// folders that are not scanned projects are dropped. Cycles are broken so
+// the result is always a DAG.
+func projectDependencies(root string, projects []string) map[string][]string {
+	known := make(map[string]bool, len(projects))
+	for _, project := range projects {
+		known[project] = true
+	}
+
+	deps := make(map[string][]string, len(projects))
+	for _, project := range projects {
+		content, err := os.ReadFile(filepath.Join(root, project, "terragrunt.hcl"))
+		if err != nil {
+			continue
+		}
+
+		var paths []string
+		for _, match := range dependencyPattern.FindAllStringSubmatch(string(content), -1) {
+			paths = append(paths, match[1])
+		}
+		for _, match := range dependenciesPattern.FindAllStringSubmatch(string(content), -1) {
+			for _, quoted := range quotedPattern.FindAllStringSubmatch(match[1], -1) {
+				paths = append(paths, quoted[1])
+			}
+		}
+
+		seen := make(map[string]bool)
+		for _, p := range paths {
+			p = strings.TrimPrefix(p, "${get_terragrunt_dir()}/")
+			if strings.Contains(p, "${") || path.IsAbs(p) {
+				log.Debugf("ignoring dynamic dependency %q of %s", p, project)
+				continue
+			}
+			upstream := path.Join(project, p)
+			if known[upstream] && upstream != project && !seen[upstream] {
+				seen[upstream] = true
+				deps[project] = append(deps[project], upstream)
+			}
+		}
+		sort.Strings(deps[project])
+	}
+
+	breakCycles(projects, deps)
+	return deps
+}
+
+// breakCycles drops the dependencies between projects that are part of, or
+// downstream of, a dependency cycle, so that they do not wait on each other
+// forever. Dependencies on projects outside the cycle are kept.
+func breakCycles(projects []string, deps map[string][]string) {
+	pending := make(map[string]int, len(projects))
+	downstream := make(map[string][]string)
+	for _, project := range projects {
+		pending[project] = len(deps[project])
+		for _, upstream := range deps[project] {
+			downstream[upstream] = append(downstream[upstream], project)
+		}
+	}
+
+	var ready []string
+	for _, project := range projects {
+		if pending[project] == 0 {
+			ready = append(ready, project)
+		}
+	}
+	for len(ready) > 0 {
+		project := ready[0]
+		ready = ready[1:]
+		for _, d := range downstream[project] {
+			pending[d]--
+			if pending[d] == 0 {
+				ready = append(ready, d)
+			}
+		}
+	}
+
+	for _, project := range projects {
+		if pending[project] == 0 {
+			continue
+		}
+		log.Warnf("dependency cycle involving %s, ignoring its dependencies on the cycle", project)
+		var acyclic []string
+		for _, upstream := range deps[project] {
+			if pending[upstream] == 0 {
+				acyclic = append(acyclic, upstream)
+			}
+		}
+		deps[project] = acyclic
+	}
+}
@@ -1,128 +1,449 @@
 package drift
 
 import (
+	"atlantis-drift-detector/config"
+	"atlantis-drift-detector/ignore"
 	"atlantis-drift-detector/notifier"
-	"encoding/json"
+	"atlantis-drift-detector/plan"
+	"atlantis-drift-detector/redact"
+	"atlantis-drift-detector/report"
+	"atlantis-drift-detector/severity"
+	"atlantis-drift-detector/source"
+	"context"
+	"errors"
 	"fmt"
-	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/golang-jwt/jwt/v4"
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/src-d/go-git.v4"
-	httpauth "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
 )
 
-type AuthTokenClaim struct {
-	*jwt.StandardClaims
+// severityRules rate drifted projects, see UseSeverityRules.
+var severityRules = severity.DefaultRules
+
+// UseSeverityRules replaces the default rules drifted projects are rated by.
+func UseSeverityRules(rules *severity.Rules) {
+	severityRules = rules
 }
 
-type InstallationAuthResponse struct {
-	Token       string    `json:"token"`
-	ExpiresAt   time.Time `json:"expires_at"`
-	Permissions struct {
-		Checks       string `json:"checks"`
-		Contents     string `json:"contents"`
-		Deployments  string `json:"deployments"`
-		Metadata     string `json:"metadata"`
-		PullRequests string `json:"pull_requests"`
-		Statuses     string `json:"statuses"`
-	} `json:"permissions"`
-	RepositorySelection string `json:"repository_selection"`
+// ignoreFile holds global ignore rules applied on top of each repository's
+// own, see UseIgnoreFile.
+var ignoreFile string
+
+// UseIgnoreFile applies the ignore rules in file to every scanned repository.
+func UseIgnoreFile(file string) {
+	ignoreFile = file
 }
 
-func DetectDrift(repoList []string, ghAppSlug, ghAppId, ghAppKeyFile, ghInstallationId string) {
+// semaphore limits the number of plans running at the same time across all
+// repos being scanned, see UseConcurrency.
+var semaphore = make(chan struct{}, 12)
+
+// UseConcurrency sets how many projects are planned at the same time. It
+// must not be called while a scan is running.
+func UseConcurrency(n int) {
+	if n != cap(semaphore) {
+		semaphore = make(chan struct{}, n)
+	}
+}
 
-	const maxConcurrentGoroutines = 12
-	semaphore := make(chan struct{}, maxConcurrentGoroutines)
+// Repo is a repository to scan together with its settings.
+type Repo struct {
+	Source source.Source
+	Config config.RepoConfig
+	// Projects limits a run to these projects, paths relative to the repo.
+	// Such a partial run is neither stored, nor notified, nor does it move
+	// the incremental baseline.
+	Projects []string
+	// DryRun plans every selected project but, like a partial run, is
+	// neither stored, nor notified, nor does it move the incremental
+	// baseline.
+	DryRun bool
+	// Dest is the folder the repo is cloned to, its name when empty.
+	Dest string
+}
 
-	for _, repo := range repoList {
+// parallelRepos is how many repos of a DetectDrift call are scanned at the
+// same time, see UseParallelRepos.
+var parallelRepos = 4
 
-		repoFolder := strings.Split(repo, "/")[2]
-		err := cloneRepo(repo, repoFolder, ghAppId, ghAppKeyFile, ghInstallationId)
-		if err != nil {
-			log.Errorf("error cloning repo: %v", err)
+// UseParallelRepos sets how many repos of a run are scanned at the same
+// time. Their plans still share the concurrency limits.
+func UseParallelRepos(n int) {
+	parallelRepos = n
+}
+
+// DetectDrift scans repos and returns their reports. Repos that could not
+// be scanned at all are missing from the reports and make up the error.
+// Cancelling ctx interrupts running plans, the repos being scanned are then
+// neither stored nor notified. Repos without a Dest are cloned to their
+// name, which must be unique.
+func DetectDrift(ctx context.Context, repos []Repo) ([]*report.Report, error) {
+	reports := make([]*report.Report, len(repos))
+	errs := make([]error, len(repos))
+	started := make([]bool, len(repos))
+	slots := make(chan struct{}, parallelRepos)
+	var wg sync.WaitGroup
+	for i, repo := range repos {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		started[i] = true
+		wg.Add(1)
+		go func(i int, repo Repo) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			repoReport, err := scanRepo(ctx, repo)
+			if err != nil {
+				errs[i] = fmt.Errorf("%s: %w", repo.Source.Name(), err)
+				return
+			}
+			reports[i] = repoReport
+		}(i, repo)
+	}
+	wg.Wait()
+	measurePluginCache()
+
+	var scanned []*report.Report
+	var scanErrs []error
+	for i := range repos {
+		switch {
+		case !started[i]:
+			scanErrs = append(scanErrs, ctx.Err())
+		case errs[i] != nil:
+			scanErrs = append(scanErrs, errs[i])
+		default:
+			scanned = append(scanned, reports[i])
+		}
+		if !started[i] {
+			break
 		}
+	}
+	return scanned, errors.Join(scanErrs...)
+}
 
-		log.Info("looking for some drifts in " + repoFolder)
+func scanRepo(ctx context.Context, repo Repo) (*report.Report, error) {
 
-		driftFolders, err := findTerragruntDirs(repoFolder)
+	src := repo.Source
+	repoFolder := src.Name()
+	dest := repo.Dest
+	if dest == "" {
+		dest = repoFolder
+	}
+	workspace, err := src.Checkout(dest)
+	if err != nil {
+		log.Errorf("error cloning repo: %v", err)
+		return nil, err
+	}
+	defer workspace.Release()
+	workDir := workspace.Dir
+
+	log.Infof("looking for some drifts in %s at %s", repoFolder, workspace.Commit)
+
+	driftFolders, err := findProjectDirs(workDir, repo.Config.Runner)
+	if err != nil {
+		log.Warnf("error finding %s directories: %v", repo.Config.Runner, err)
+		return nil, err
+	}
+
+	// Projects are identified by their directory relative to the repository,
+	// whatever directory the source checked it out to.
+	var projects []string
+	for _, driftFolder := range driftFolders {
+		rel, err := filepath.Rel(workDir, driftFolder)
 		if err != nil {
-			log.Warnf("error finding Terragrunt directories: %v", err)
 			continue
 		}
+		rel = filepath.ToSlash(rel)
+		if !repo.selects(rel) {
+			continue
+		}
+		projects = append(projects, rel)
+	}
+
+	// Kubernetes projects are compared with the cluster instead of planned
+	kubeProjects := make(map[string]kubeProject)
+	if len(repo.Config.Kubernetes.Include) > 0 {
+		kubeDirs, err := findKubernetesDirs(workDir)
+		if err != nil {
+			log.Warnf("error finding kubernetes directories: %v", err)
+			return nil, err
+		}
+		for dir, kind := range kubeDirs {
+			rel, err := filepath.Rel(workDir, dir)
+			if err != nil {
+				continue
+			}
+			rel = filepath.ToSlash(rel)
+			if isProjectDir(dir, repo.Config.Runner) || !repo.selectsKubernetes(rel) {
+				continue
+			}
+			kubeProjects[rel] = kubeProject{kind: kind, context: repo.Config.ProjectContext(rel), namespace: repo.Config.Kubernetes.Namespace}
+			projects = append(projects, rel)
+		}
+		sort.Strings(projects)
+	}
+
+	rules, err := ignore.Load(ignoreFile, filepath.Join(workDir, ignore.RepoFile))
+	if err != nil {
+		log.Errorf("error loading ignore rules of %s, no changes will be suppressed: %v", repoFolder, err)
+		rules = nil
+	}
 
-		// Channels to collect results from goroutines.
-		errorCh := make(chan string, len(driftFolders))
-		driftedCh := make(chan string, len(driftFolders))
-		freshCh := make(chan string, len(driftFolders))
+	partial := len(repo.Projects) > 0 || repo.DryRun
+	if len(repo.Projects) > 0 && len(projects) == 0 {
+		return nil, fmt.Errorf("none of the projects %s found", strings.Join(repo.Projects, ", "))
+	}
 
-		// Wait group to wait for all goroutines to finish.
-		var wg sync.WaitGroup
+	state := loadState(repoFolder)
+	var toPlan map[string]bool
+	var skipped map[string]report.Result
+	if !partial {
+		toPlan, skipped = incrementalPlan(repoFolder, workspace, projects, state)
+	}
 
-		for _, driftFolder := range driftFolders {
-			if strings.Split(driftFolder, "/")[1] != "prod" && strings.Split(driftFolder, "/")[1] != "dev" {
-				continue
+	// Upstream dependencies are planned first. A project whose upstream
+	// failed is not planned and is reported as blocked by the root cause.
+	deps := projectDependencies(workDir, projects)
+	atlantis := atlantisVersions(workDir)
+	results := make(map[string]report.Result, len(projects))
+	var resultsMu sync.Mutex
+	done := make(map[string]chan struct{}, len(projects))
+	for _, rel := range projects {
+		done[rel] = make(chan struct{})
+	}
+
+	// A repo scoped executor plans all projects at once, dependencies included
+	var remote map[string]report.Result
+	if executor != nil && executor.Scope() == ScopeRepo {
+		task := Task{Repo: repo.Config, Name: repoFolder, Commit: workspace.Commit}
+		for _, rel := range projects {
+			if toPlan == nil || toPlan[rel] {
+				task.Projects = append(task.Projects, rel)
+			}
+		}
+		if len(task.Projects) > 0 {
+			select {
+			case semaphore <- struct{}{}: // Acquire
+				remote = runRemote(ctx, task)
+				<-semaphore // Release
+			case <-ctx.Done():
+				// The scan is thrown away, this only keeps projects from being planned
+				remote = make(map[string]report.Result)
 			}
+		}
+	}
 
-			wg.Add(1)
-			semaphore <- struct{}{} // Acquire
-			go func(df string) {    // Start a new goroutine.
-				defer func() {
-					<-semaphore // Release
-					wg.Done()
-				}()
-
-				drifted, err := planRun(repoFolder, df)
-				if err != nil {
-					errorCh <- df
-					return
+	// Wait group to wait for all goroutines to finish.
+	var wg sync.WaitGroup
+
+	for _, rel := range projects {
+		wg.Add(1)
+		go func(rel string) { // Start a new goroutine.
+			defer func() {
+				close(done[rel])
+				wg.Done()
+			}()
+
+			var blockedBy string
+			for _, upstream := range deps[rel] {
+				<-done[upstream]
+				resultsMu.Lock()
+				upstreamResult := results[upstream]
+				resultsMu.Unlock()
+				if blockedBy != "" {
+					continue
 				}
-				if drifted {
-					driftedCh <- df
-				} else {
-					freshCh <- df
+				switch upstreamResult.Status {
+				case report.StatusError:
+					blockedBy = upstreamResult.Project
+				case report.StatusBlocked:
+					blockedBy = upstreamResult.BlockedBy
 				}
-			}(driftFolder)
+			}
 
-		}
+			var result report.Result
+			switch {
+			case blockedBy != "":
+				log.Infof("blocked project %s/%s by %s", repoFolder, rel, blockedBy)
+				result = report.Result{Project: repoFolder + "/" + rel, Status: report.StatusBlocked, Commit: workspace.Commit, BlockedBy: blockedBy}
+			case toPlan != nil && !toPlan[rel]:
+				result = skipped[rel]
+			case remote != nil:
+				result = remote[rel]
+			default:
+				t := target{
+					ctx:     ctx,
+					project: repoFolder + "/" + rel,
+					dir:     filepath.Join(workDir, rel),
+					runner:  repo.Config.Runner,
+					bin:     repo.Config.Runner,
+					env:     planEnv(repo.Config.Runner, repo.Config.ProjectContext(rel), repo.Config.ProjectEnv(rel)),
+				}
+				var ok bool
+				result, ok = withSlot(ctx, repo.Config.ProjectAccount(rel), func(s *slot) report.Result {
+					t.slot = s
+					if executor != nil {
+						task := Task{Repo: repo.Config, Name: repoFolder, Commit: workspace.Commit, Projects: []string{rel}}
+						return runRemote(ctx, task)[rel]
+					}
+					if project, ok := kubeProjects[rel]; ok {
+						return runKubernetes(t, project, rel, workspace.Commit, rules)
+					}
+					tools, err := resolveTools(workDir, rel, repo.Config.Runner, atlantis)
+					if err != nil {
+						log.Warnf("error picking the versions of project %s: %v", t.project, err)
+						return report.Result{Project: t.project, Status: report.StatusError, Commit: workspace.Commit, Output: err.Error()}
+					}
+					return runProject(t.use(tools), rel, workspace.Commit, rules)
+				})
+				if !ok {
+					// The scan is thrown away, this only unblocks dependents
+					result = report.Result{Project: t.project, Status: report.StatusError, Commit: workspace.Commit}
+				}
+			}
+
+			resultsMu.Lock()
+			results[rel] = result
+			resultsMu.Unlock()
+		}(rel)
+	}
 
-		// Wait for all the goroutines to finish.
-		wg.Wait()
-		close(errorCh)
-		close(driftedCh)
-		close(freshCh)
+	// Wait for all the goroutines to finish.
+	wg.Wait()
 
-		// Convert channels to slices.
-		errorProjects := make([]string, 0, len(driftFolders))
-		for err := range errorCh {
-			errorProjects = append(errorProjects, err)
+	if ctx.Err() != nil {
+		log.Infof("scan of %s was cancelled", repoFolder)
+		return nil, ctx.Err()
+	}
+
+	repoReport := &report.Report{Repo: repoFolder, Commit: workspace.Commit}
+	for _, rel := range projects {
+		repoReport.Results = append(repoReport.Results, results[rel])
+	}
+
+	if partial {
+		redact.Report(repoReport)
+		return repoReport, nil
+	}
+
+	// Only a run without errors moves the baseline incremental runs diff against
+	if toPlan == nil {
+		state.RunsSinceFull = 0
+	} else {
+		state.RunsSinceFull++
+	}
+	if len(repoReport.Projects(report.StatusError)) == 0 {
+		state.Commit = workspace.Commit
+	}
+	saveState(repoFolder, state)
+
+	notifier.Notify(repoReport, repo.Config.Notifiers)
+	return repoReport, nil
+}
+
+// selects reports whether the project rel is scanned. A partial run scans
+// the projects it asked for, even those the include and exclude globs skip.
+func (repo Repo) selects(rel string) bool {
+	if len(repo.Projects) == 0 {
+		return repo.Config.Selects(rel)
+	}
+	for _, project := range repo.Projects {
+		if strings.Trim(project, "/") == rel {
+			return true
 		}
-		driftedProjects := make([]string, 0, len(driftFolders))
-		for dp := range driftedCh {
-			driftedProjects = append(driftedProjects, dp)
+	}
+	return false
+}
+
+// selectsKubernetes reports whether the Kubernetes project rel is scanned,
+// like selects but with the kubernetes globs.
+func (repo Repo) selectsKubernetes(rel string) bool {
+	if len(repo.Projects) == 0 {
+		return repo.Config.Kubernetes.Selects(rel)
+	}
+	return repo.selects(rel)
+}
+
+// runProject plans a single project and turns the outcome into a result.
+// Resource changes matched by rules are suppressed, and a project whose
+// changes are all suppressed counts as having no changes.
+func runProject(t target, rel, commit string, rules *ignore.Rules) report.Result {
+	project := t.project
+	result := report.Result{Project: project, Commit: commit, TerraformVersion: t.terraformVersion, TerragruntVersion: t.terragruntVersion}
+	outcome, attempts, err := planWithRetries(t)
+	result.Output = outcome.output
+	if len(attempts) > 1 {
+		result.Attempts = attempts
+		result.Flaky = err == nil
+	}
+	drifted := outcome.drifted
+	if err == nil && outcome.plan != nil {
+		result.Changes, result.Suppressed = rules.Apply(rel, outcome.plan.ResourceChanges)
+		attachDiffs(outcome.plan, outcome.plan.ResourceChanges, result.Changes)
+		attachDiffs(outcome.plan, outcome.plan.ResourceChanges, result.Suppressed)
+		if drifted && len(result.Changes) == 0 {
+			log.Infof("all changes of project %s are suppressed", project)
+			drifted = false
 		}
-		freshProjects := make([]string, 0, len(driftFolders))
-		for fp := range freshCh {
-			freshProjects = append(freshProjects, fp)
+	}
+
+	status := report.StatusDrifted
+	if err == nil && outcome.plan != nil && outcome.refresh != nil {
+		var suppressed []report.Change
+		result.Drift, suppressed = rules.Apply(rel, outcome.refresh.ResourceDrift)
+		attachDiffs(outcome.refresh, outcome.refresh.ResourceDrift, result.Drift)
+		attachDiffs(outcome.refresh, outcome.refresh.ResourceDrift, suppressed)
+		result.Suppressed = append(result.Suppressed, suppressed...)
+		status = classifyDrift(result.Changes, result.Drift)
+		drifted = status != report.StatusNoChanges
+	}
+
+	switch {
+	case err != nil:
+		result.Status = report.StatusError
+	case drifted:
+		result.Status = status
+		result.Severity = severityRules.Score(append(result.Changes, result.Drift...))
+		if result.Severity == "" {
+			// Without plan details there is nothing to score
+			result.Severity = severityRules.Default
 		}
+	default:
+		result.Status = report.StatusNoChanges
+	}
+	return result
+}
 
-		err = os.RemoveAll(repoFolder)
-		if err != nil {
-			log.Warnf("error removing directory: %v", err)
+// attachDiffs fills in the redacted attribute values of changes from the
+// resource changes they were built from.
+func attachDiffs(p *plan.Plan, resources []plan.ResourceChange, changes []report.Change) {
+	byAddress := make(map[string]*plan.ResourceChange, len(resources))
+	for i := range resources {
+		byAddress[resources[i].Address] = &resources[i]
+	}
+	for i := range changes {
+		if rc, ok := byAddress[changes[i].Address]; ok {
+			changes[i].Diff = redact.Diff(p, rc, changes[i].Attributes)
 		}
-		notifier.Notify(repoFolder, driftedProjects, errorProjects, freshProjects)
 	}
 }
 
-// findTerragruntDirs walks through the file tree starting from rootDir and
-// returns a slice of directories that contain terragrunt.hcl.
-func findTerragruntDirs(rootDir string) ([]string, error) {
+// findProjectDirs walks through the file tree starting from rootDir and
+// returns a slice of directories that contain a project of runner: a
+// terragrunt.hcl, or .tf files for plain Terraform.
+func findProjectDirs(rootDir, runner string) ([]string, error) {
 	var dirs []string
 
 	// Walk through each file and directory in the tree.
@@ -136,11 +457,9 @@ func findTerragruntDirs(rootDir string) ([]string, error) {
 			return filepath.SkipDir
 		}
 
-		// If the item is a directory and it contains terragrunt.hcl, add it to the slice.
-		if info.IsDir() {
-			if _, err := os.Stat(filepath.Join(path, "terragrunt.hcl")); err == nil {
-				dirs = append(dirs, path)
-			}
+		// If the item is a directory and it contains a project, add it to the slice.
+		if info.IsDir() && isProjectDir(path, runner) {
+			dirs = append(dirs, path)
 		}
 		return nil
 	})
@@ -149,102 +468,158 @@ func findTerragruntDirs(rootDir string) ([]string, error) {
 	return dirs, err
 }
 
-func cloneRepo(repo, repoFolder, ghAppId, ghAppKeyFile, ghInstallationId string) error {
-	keyBytes, err := os.ReadFile(ghAppKeyFile)
-	if err != nil {
-		log.Warnf("error reading key: %v", err)
+func isProjectDir(dir, runner string) bool {
+	if runner == "terraform" {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.tf"))
+		return len(files) > 0
 	}
+	_, err := os.Stat(filepath.Join(dir, "terragrunt.hcl"))
+	return err == nil
+}
 
-	rsaPrivateKey, err := jwt.ParseRSAPrivateKeyFromPEM(keyBytes)
-	if err != nil {
-		log.Warnf("error parsing RSA private key from pem: %v", err)
+// planEnv returns the environment plans of runner run with, the detector's
+// own, the plugin cache's, the kubeconfig's for kubeContext and the
+// variables of the project's credential mapping.
+func planEnv(runner, kubeContext string, vars map[string]string) []string {
+	env := append(os.Environ(), pluginCacheEnv(runner)...)
+	env = append(env, kubeEnv(kubeContext)...)
+	for key, value := range vars {
+		env = append(env, key+"="+value)
 	}
+	return env
+}
 
-	jwtToken := jwt.New(jwt.SigningMethodRS256)
+// target is a single project to plan.
+type target struct {
+	// ctx interrupts the plan when cancelled.
+	ctx context.Context
+	// project is the name results are reported under, repo/path.
+	project string
+	dir     string
+	// runner is terragrunt or terraform, bin its binary.
+	runner string
+	bin    string
+	env    []string
+	// terraformVersion and terragruntVersion are reported with the result.
+	terraformVersion  string
+	terragruntVersion string
+	// slot is given up while waiting to retry, nil when the plan holds none.
+	slot *slot
+}
 
-	jwtToken.Claims = &AuthTokenClaim{
-		&jwt.StandardClaims{
-			IssuedAt:  time.Now().Unix(),
-			ExpiresAt: time.Now().Add(time.Minute * 1).Unix(),
-			Issuer:    ghAppId,
-		},
-	}
+// cancelGracePeriod is how long a cancelled plan may take to stop after
+// being interrupted before it is killed.
+const cancelGracePeriod = 30 * time.Second
+
+// command returns runner with args, set up to run in the project. When the
+// context is cancelled the command is interrupted, which Terragrunt passes
+// on to Terraform so that it can stop cleanly.
+func (t target) command(args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(t.ctx, t.bin, args...)
+	cmd.Dir = t.dir
+	cmd.Env = t.env
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = cancelGracePeriod
+	return cmd
+}
 
-	tokenString, err := jwtToken.SignedString(rsaPrivateKey)
-	if err != nil {
-		log.Warnf("error getting jwt token string: %v", err)
-	}
+// planOutcome is what planRun learned about a project.
+type planOutcome struct {
+	drifted bool
+	// plan is the saved plan, nil when it could not be read.
+	plan *plan.Plan
+	// refresh is the refresh-only plan, nil unless refresh-only mode is on.
+	refresh *plan.Plan
+	// output is the tail of the plan output when planning failed.
+	output string
+}
 
-	client := &http.Client{}
-	req, _ := http.NewRequest("POST", "https://api.github.com/app/installations/"+ghInstallationId+"/access_tokens", nil)
-	req.Header.Set("Accept", "application/vnd.github.machine-man-preview+json")
-	req.Header.Set("Authorization", "Bearer "+tokenString)
-	res, err := client.Do(req)
-	if err != nil {
-		log.Warnf("error making github api request: %v", err)
-		return err
-	}
+// outputLines is how much of the output of a failed plan is kept.
+const outputLines = 50
 
-	decoder := json.NewDecoder(res.Body)
-	var installationAuthResponse InstallationAuthResponse
-	err = decoder.Decode(&installationAuthResponse)
-	if err != nil {
-		log.Warnf("error decoding auth response: %v", err)
+// tail returns the last outputLines lines of out.
+func tail(out []byte) string {
+	lines := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+	if len(lines) > outputLines {
+		lines = lines[len(lines)-outputLines:]
 	}
+	return strings.Join(lines, "\n")
+}
 
-	//fmt.Printf("Token: %s\n", installationAuthResponse.Token)
-	r, err := git.PlainClone(repoFolder, false, &git.CloneOptions{
-		URL: "https://" + repo + ".git",
-		Auth: &httpauth.BasicAuth{
-			Username: "x-access-token", // Yes, this can be anything except an empty string.
-			Password: installationAuthResponse.Token,
-		},
-	})
+func planRun(t target) (outcome planOutcome, err error) {
+	project := t.project
+	defer cleanUp(t)
 
-	if err != nil {
-		log.Warnf("error cloning repository: %v", err)
-		return err
-	}
+	// Terragrunt initializes on its own, plain Terraform does not
+	if t.runner == "terraform" {
+		cache := newPlanCache(project)
+		if cache != nil {
+			defer cache.remove()
+			t.env = append(t.env[:len(t.env):len(t.env)], cache.env()...)
+		}
 
-	_, err = r.Head()
-	if err != nil {
-		log.Warnf("error verifying repository was cloned correctly: %v", err)
-		return err
+		log.Debug("running init in " + project)
+		out, err := t.command("init", "-input=false").Output()
+		countPluginCacheUse(out)
+		if err != nil {
+			log.Infof("error initializing project %s: %s", project, err)
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				outcome.output = tail(append(out, exitErr.Stderr...))
+			}
+			return outcome, err
+		}
+		if cache != nil {
+			cache.publish()
+		}
 	}
 
-	return nil
-}
-
-func planRun(repoFolder, driftFolder string) (drifted bool, err error) {
-
 	// Run plan
-	log.Debug("running plan in " + driftFolder)
-	cmdPlan := exec.Command("terragrunt", "plan", "-lock=false", "-out=tfplan.out")
-	cmdPlan.Dir = driftFolder
-	cmdPlan.Env = os.Environ()
-	if strings.Contains(driftFolder, "prod") {
-		cmdPlan.Env = append(cmdPlan.Env, "AWS_PROFILE=prod")
-		cmdPlan.Env = append(cmdPlan.Env, "TF_VAR_aws_profile=prod")
-	} else if strings.Contains(driftFolder, "dev") {
-		cmdPlan.Env = append(cmdPlan.Env, "AWS_PROFILE=dev")
-		cmdPlan.Env = append(cmdPlan.Env, "TF_VAR_aws_profile=dev")
-	}
+	log.Debug("running plan in " + project)
+	cmdPlan := t.command("plan", "-lock=false", "-out=tfplan.out")
 
 	out, err := cmdPlan.Output()
 	if err != nil {
-		log.Infof("error project %s: %s", driftFolder, err)
-		return false, err
+		log.Infof("error project %s: %s", project, err)
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			outcome.output = tail(append(out, exitErr.Stderr...))
+		}
+		return outcome, err
+	}
+	if t.runner != "terraform" {
+		countPluginCacheUse(out)
 	}
 
-	// Clean up
-	cmdCleanUp := exec.Command("rm", "-rf", ".terragrunt-cache")
-	cmdCleanUp.Dir = driftFolder
-	err = cmdCleanUp.Run()
+	outcome.drifted, err = parsePlanOutput(out, project)
 	if err != nil {
-		log.Warnf("error cleaning cache: %s", err)
+		outcome.output = tail(out)
 	}
 
-	return parsePlanOutput(out, driftFolder)
+	// The saved plan is needed to tell which resources drifted, and in
+	// refresh-only mode to tell drift from unapplied code
+	if err == nil && (outcome.drifted || refreshOnly) {
+		outcome.plan, err = showPlan(t, "tfplan.out")
+		if err != nil {
+			log.Warnf("error reading plan of %s, reporting it without resource details: %s", project, err)
+			err = nil
+		}
+	}
+	if err == nil && refreshOnly {
+		outcome.refresh, err = refreshPlanRun(t)
+		if err != nil {
+			log.Infof("error refresh-only project %s: %s", project, err)
+		}
+	}
+
+	return outcome, err
+}
+
+// showPlan converts a plan saved by planRun into its JSON representation.
+func showPlan(t target, planFile string) (*plan.Plan, error) {
+	out, err := t.command("show", "-json", planFile).Output()
+	if err != nil {
+		return nil, err
+	}
+	return plan.Parse(out)
 }
 
 func parsePlanOutput(out []byte, project string) (bool, error) {
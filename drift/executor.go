@@ -0,0 +1,72 @@
+package drift
+
+import (
+	"atlantis-drift-detector/config"
+	"atlantis-drift-detector/report"
+	"context"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Scopes of an Executor.
+const (
+	ScopeProject = "project"
+	ScopeRepo    = "repo"
+)
+
+// Task is a set of projects of one repo to plan at a commit.
+type Task struct {
+	Repo config.RepoConfig
+	// Name is the folder the repo is reported under.
+	Name   string
+	Commit string
+	// Projects are paths relative to the repo.
+	Projects []string
+}
+
+// Executor plans projects outside of the detector process, e.g. in
+// Kubernetes Jobs.
+type Executor interface {
+	// Scope is ScopeProject when every task holds a single project, or
+	// ScopeRepo when a task holds all projects planned in a repo.
+	Scope() string
+	// Run plans the projects of task and returns their results, with
+	// ignore rules and severity applied.
+	Run(ctx context.Context, task Task) ([]report.Result, error)
+}
+
+// executor runs plans, or nil to run them as child processes, see
+// UseExecutor.
+var executor Executor
+
+// UseExecutor makes plans run through e, or as child processes of the
+// detector when e is nil.
+func UseExecutor(e Executor) {
+	executor = e
+}
+
+// runRemote plans task through the executor and returns the results by
+// project. Projects the executor returned no result for are errors.
+func runRemote(ctx context.Context, task Task) map[string]report.Result {
+	returned, err := executor.Run(ctx, task)
+	if err != nil {
+		log.Errorf("error planning %s with the %s executor: %v", task.Name, executor.Scope(), err)
+	}
+
+	results := make(map[string]report.Result, len(task.Projects))
+	for _, result := range returned {
+		results[strings.TrimPrefix(result.Project, task.Name+"/")] = result
+	}
+	for _, rel := range task.Projects {
+		if _, ok := results[rel]; ok {
+			continue
+		}
+		result := report.Result{Project: task.Name + "/" + rel, Status: report.StatusError, Commit: task.Commit}
+		if err != nil {
+			result.Output = err.Error()
+		}
+		results[rel] = result
+	}
+	return results
+}
@@ -0,0 +1,192 @@
+package drift
+
+import (
+	"atlantis-drift-detector/report"
+	"atlantis-drift-detector/source"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stateDir is where run state is kept between runs, see UseStateDir.
+var stateDir = "csv/state"
+
+// UseStateDir keeps incremental run state in dir.
+func UseStateDir(dir string) {
+	stateDir = dir
+}
+
+// fullRunEvery enables incremental mode when greater than zero, see
+// UseIncremental.
+var fullRunEvery int
+
+// moduleSourcePattern matches source attributes in terragrunt.hcl and .tf
+// files, e.g. source = "../../modules//vpc".
+var moduleSourcePattern = regexp.MustCompile(`(?m)^\s*source\s*=\s*"([^"]+)"`)
+
+// UseIncremental makes DetectDrift re-plan only projects affected by changes
+// since the last clean run. Every fullEvery-th run still plans everything,
+// because drift can also originate on the cloud side. A value of zero or
+// less disables incremental mode.
+func UseIncremental(fullEvery int) {
+	fullRunEvery = fullEvery
+}
+
+// repoState is persisted between runs to support incremental mode.
+type repoState struct {
+	// Commit is the revision of the last run in which no project errored.
+	Commit        string `json:"commit"`
+	RunsSinceFull int    `json:"runs_since_full"`
+}
+
+func statePath(repo string) string {
+	return filepath.Join(stateDir, repo+"_state.json")
+}
+
+func loadState(repo string) *repoState {
+	state := &repoState{}
+	data, err := os.ReadFile(statePath(repo))
+	if err != nil {
+		return state
+	}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		log.Warnf("error reading state of %s: %v", repo, err)
+		return &repoState{}
+	}
+	return state
+}
+
+func saveState(repo string, state *repoState) {
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = os.MkdirAll(stateDir, 0755)
+	}
+	if err == nil {
+		err = os.WriteFile(statePath(repo), data, 0644)
+	}
+	if err != nil {
+		log.Warnf("error saving state of %s: %v", repo, err)
+	}
+}
+
+// incrementalPlan decides which projects of repo need planning in this run.
+// It returns the projects to plan, keyed by their directory relative to the
+// repository root, together with the previous results of every project that
+// is skipped. Projects that errored or were blocked are always re-planned.
+// A nil map means everything must be planned.
+func incrementalPlan(repo string, workspace *source.Workspace, projects []string, state *repoState) (map[string]bool, map[string]report.Result) {
+	if fullRunEvery <= 0 {
+		return nil, nil
+	}
+	if state.Commit == "" || workspace.Commit == "" {
+		log.Infof("no previous clean run of %s, planning everything", repo)
+		return nil, nil
+	}
+	if state.RunsSinceFull+1 >= fullRunEvery {
+		log.Infof("periodic full run of %s", repo)
+		return nil, nil
+	}
+
+	previous, err := report.Load(repo)
+	if err != nil {
+		log.Infof("no previous report of %s, planning everything: %v", repo, err)
+		return nil, nil
+	}
+
+	changed, err := source.ChangedFiles(workspace.Dir, state.Commit, workspace.Commit)
+	if err != nil {
+		log.Infof("cannot diff %s against %s, planning everything: %v", repo, state.Commit, err)
+		return nil, nil
+	}
+
+	previousResults := make(map[string]report.Result)
+	for _, result := range previous.Results {
+		previousResults[result.Project] = result
+	}
+
+	plan := make(map[string]bool)
+	skipped := make(map[string]report.Result)
+	for _, project := range projects {
+		result, seen := previousResults[path.Join(repo, project)]
+		failed := result.Status == report.StatusError || result.Status == report.StatusBlocked
+		if !seen || failed || projectAffected(workspace.Dir, project, changed) {
+			plan[project] = true
+		} else {
+			skipped[project] = result
+		}
+	}
+	log.Infof("incremental run of %s: %d of %d projects affected since %s", repo, len(plan), len(projects), state.Commit)
+
+	return plan, skipped
+}
+
+// projectAffected reports whether any of the changed files can influence the
+// plan of project: files inside the project, files directly inside one of
+// its parent folders (included terragrunt.hcl and shared .hcl files) and the
+// local modules it references.
+func projectAffected(root, project string, changed []string) bool {
+	watched := []string{project}
+	watched = append(watched, localModules(root, project, map[string]bool{})...)
+
+	for _, file := range changed {
+		for _, dir := range watched {
+			if strings.HasPrefix(file, dir+"/") {
+				return true
+			}
+		}
+		if !sharedConfigFile(file) {
+			continue
+		}
+		if dir := path.Dir(file); dir == "." || strings.HasPrefix(project, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedConfigFile reports whether file is of a kind parent folders use to
+// share configuration with the projects below them.
+func sharedConfigFile(file string) bool {
+	switch path.Ext(file) {
+	case ".hcl", ".yaml", ".yml", ".json", ".tfvars":
+		return true
+	}
+	return false
+}
+
+// localModules returns the directories, relative to root, of local modules
+// referenced from dir and, recursively, from those modules.
+func localModules(root, dir string, seen map[string]bool) []string {
+	var modules []string
+
+	files, _ := filepath.Glob(filepath.Join(root, dir, "*.tf"))
+	files = append(files, filepath.Join(root, dir, "terragrunt.hcl"))
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		for _, match := range moduleSourcePattern.FindAllStringSubmatch(string(content), -1) {
+			src := match[1]
+			if !strings.HasPrefix(src, "./") && !strings.HasPrefix(src, "../") {
+				continue
+			}
+			// Terragrunt separates the repo part from a sub directory with //
+			src = strings.Replace(src, "//", "/", 1)
+			module := path.Join(dir, src)
+			if strings.HasPrefix(module, "../") || seen[module] {
+				continue
+			}
+			seen[module] = true
+			modules = append(modules, module)
+			modules = append(modules, localModules(root, module, seen)...)
+		}
+	}
+	return modules
+}
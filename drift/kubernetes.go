@@ -0,0 +1,492 @@
+package drift
+
+import (
+	"atlantis-drift-detector/ignore"
+	"atlantis-drift-detector/plan"
+	"atlantis-drift-detector/report"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// Kinds of Kubernetes projects.
+const (
+	kindHelm      = "helm"
+	kindKustomize = "kustomize"
+	kindManifests = "manifests"
+)
+
+// kubeProject is a folder of Kubernetes resources compared with a cluster.
+type kubeProject struct {
+	kind string
+	// context is the kubeconfig context, the current one when empty.
+	context string
+	// namespace is where Helm releases are installed.
+	namespace string
+}
+
+// kubeconfigPath is the kubeconfig the detector merged, see UseKubeconfig.
+var kubeconfigPath string
+
+// UseKubeconfig points kubectl, helm and the kubernetes and helm providers
+// of plans at the kubeconfig at path, the default kubeconfig when empty.
+func UseKubeconfig(path string) {
+	if path != "" {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+	}
+	kubeconfigPath = path
+}
+
+// kubeEnv returns the variables pointing plans at the kubeconfig and at
+// kubeContext, when set.
+func kubeEnv(kubeContext string) []string {
+	var env []string
+	if kubeconfigPath != "" {
+		env = append(env, "KUBECONFIG="+kubeconfigPath, "KUBE_CONFIG_PATH="+kubeconfigPath)
+	}
+	if kubeContext != "" {
+		env = append(env, "KUBE_CTX="+kubeContext)
+	}
+	return env
+}
+
+// manifestPattern matches YAML documents describing Kubernetes objects.
+var manifestPattern = regexp.MustCompile(`(?m)^apiVersion:\s*\S+`)
+
+// findKubernetesDirs walks rootDir and returns the kind of every folder
+// holding a Helm chart, a kustomization or plain manifests, by folder. The
+// folders of a chart are part of it.
+func findKubernetesDirs(rootDir string) (map[string]string, error) {
+	kinds := make(map[string]string)
+	err := filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		kind := kubernetesKind(path)
+		if kind != "" {
+			kinds[path] = kind
+		}
+		if kind == kindHelm {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return kinds, err
+}
+
+// kubernetesKind returns the kind of Kubernetes project in dir, empty when
+// it holds none.
+func kubernetesKind(dir string) string {
+	if _, err := os.Stat(filepath.Join(dir, "Chart.yaml")); err == nil {
+		return kindHelm
+	}
+	for _, name := range []string{"kustomization.yaml", "kustomization.yml", "Kustomization"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return kindKustomize
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.y*ml"))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err == nil && manifestPattern.Match(data) && bytes.Contains(data, []byte("kind:")) {
+			return kindManifests
+		}
+	}
+	return ""
+}
+
+// externalDiff makes kubectl diff print whole objects, so that they can be
+// compared attribute by attribute.
+const externalDiff = "diff -N -U1000000"
+
+// runKubernetes compares the resources of the project rel with the cluster
+// and turns the differences into a result. Manifests and kustomizations
+// are diffed with the live objects. Helm charts are rendered and compared
+// with the manifest of their release, and the release manifest is diffed
+// with the live objects to find changes made outside Helm.
+func runKubernetes(t target, project kubeProject, rel, commit string, rules *ignore.Rules) report.Result {
+	result := report.Result{Project: t.project, Commit: commit}
+
+	var changes, drift []plan.ResourceChange
+	var err error
+	switch project.kind {
+	case kindHelm:
+		changes, drift, err = diffRelease(t, project)
+	case kindKustomize:
+		changes, err = kubectlDiff(t, project, nil, "-k", ".")
+	default:
+		changes, err = kubectlDiff(t, project, nil, "-f", ".")
+	}
+	if err != nil {
+		log.Infof("error project %s: %s", t.project, err)
+		result.Status = report.StatusError
+		result.Output = err.Error()
+		return result
+	}
+
+	resources := &plan.Plan{}
+	var suppressed []report.Change
+	result.Changes, result.Suppressed = rules.Apply(rel, changes)
+	attachDiffs(resources, changes, result.Changes)
+	attachDiffs(resources, changes, result.Suppressed)
+	result.Drift, suppressed = rules.Apply(rel, drift)
+	attachDiffs(resources, drift, result.Drift)
+	attachDiffs(resources, drift, suppressed)
+	result.Suppressed = append(result.Suppressed, suppressed...)
+
+	status := report.StatusDrifted
+	if project.kind == kindHelm {
+		status = classifyDrift(result.Changes, result.Drift)
+	}
+	switch {
+	case len(result.Changes) == 0 && len(result.Drift) == 0:
+		log.Infof("fresh project %s", t.project)
+		result.Status = report.StatusNoChanges
+	default:
+		log.Infof("drifted project %s", t.project)
+		result.Status = status
+		result.Severity = severityRules.Score(append(result.Changes, result.Drift...))
+		if result.Severity == "" {
+			result.Severity = severityRules.Default
+		}
+	}
+	return result
+}
+
+// tool returns bin with args, set up like a plan of t.
+func (t target) tool(bin string, args ...string) *exec.Cmd {
+	t.bin = bin
+	return t.command(args...)
+}
+
+// diffRelease renders the chart of a Helm project with the values of its
+// release, named after the chart's folder, and compares it with the
+// release's manifest. It also diffs the release manifest with the live
+// objects.
+func diffRelease(t target, project kubeProject) (changes, drift []plan.ResourceChange, err error) {
+	release := filepath.Base(t.dir)
+	helmArgs := []string{"--namespace", project.namespace}
+	if project.context != "" {
+		helmArgs = append(helmArgs, "--kube-context", project.context)
+	}
+
+	chart, err := os.ReadFile(filepath.Join(t.dir, "Chart.yaml"))
+	if err == nil && bytes.Contains(chart, []byte("dependencies:")) {
+		_, err = run(t.tool("helm", "dependency", "build", "."))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	deployed, err := run(t.tool("helm", append([]string{"get", "manifest", release}, helmArgs...)...))
+	if err != nil && !strings.Contains(err.Error(), "release: not found") {
+		return nil, nil, err
+	}
+	templateArgs := append([]string{"template", release, "."}, helmArgs...)
+	if err != nil {
+		// A release that was never installed is all unapplied code
+		log.Infof("release %s of project %s is not installed", release, t.project)
+		deployed = nil
+	} else {
+		// The chart is rendered with the values the release was installed
+		// with, which its defaults alone would report as changes
+		values, err := releaseValues(t, release, helmArgs)
+		if err != nil {
+			return nil, nil, err
+		}
+		if values != "" {
+			defer os.Remove(values)
+			templateArgs = append(templateArgs, "--values", values)
+		}
+	}
+	rendered, err := run(t.tool("helm", templateArgs...))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	changes, err = compareManifests(deployed, rendered)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(bytes.TrimSpace(deployed)) > 0 {
+		drift, err = kubectlDiff(t, project, deployed, "-f", "-")
+	}
+	return changes, drift, err
+}
+
+// releaseValues writes the values the release was installed or upgraded
+// with to a temporary file and returns its path, empty when it has none.
+func releaseValues(t target, release string, helmArgs []string) (string, error) {
+	values, err := run(t.tool("helm", append([]string{"get", "values", release, "--output", "yaml"}, helmArgs...)...))
+	if err != nil {
+		return "", err
+	}
+	switch string(bytes.TrimSpace(values)) {
+	case "", "null", "{}":
+		return "", nil
+	}
+
+	file, err := os.CreateTemp("", "values-*.yaml")
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(values)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// kubectlDiff diffs the objects args select, read from stdin when given,
+// with the live objects of the cluster.
+func kubectlDiff(t target, project kubeProject, stdin []byte, args ...string) ([]plan.ResourceChange, error) {
+	args = append([]string{"diff", "--namespace", project.namespace}, args...)
+	if project.context != "" {
+		args = append(args, "--context", project.context)
+	}
+	cmd := t.tool("kubectl", args...)
+	cmd.Env = append(cmd.Env, "KUBECTL_EXTERNAL_DIFF="+externalDiff)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	out, err := run(cmd)
+
+	// kubectl diff exits with 1 when objects differ
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseKubectlDiff(out)
+}
+
+// run runs cmd and returns its output, or an error with the tail of its
+// output.
+func run(cmd *exec.Cmd) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if message := tail(bytes.TrimSpace(stderr.Bytes())); message != "" {
+			return out, &toolError{err: err, output: message}
+		}
+		return out, err
+	}
+	return out, nil
+}
+
+// toolError is a failed kubectl or helm command with its output.
+type toolError struct {
+	err    error
+	output string
+}
+
+func (e *toolError) Error() string { return e.output }
+func (e *toolError) Unwrap() error { return e.err }
+
+// parseKubectlDiff turns the unified diff kubectl diff prints with
+// externalDiff, every object in full, into resource changes.
+func parseKubectlDiff(out []byte) ([]plan.ResourceChange, error) {
+	var changes []plan.ResourceChange
+	var before, after strings.Builder
+	inHunk := false
+	flush := func() error {
+		if !inHunk {
+			return nil
+		}
+		change, err := resourceChange([]byte(before.String()), []byte(after.String()))
+		if err != nil {
+			return err
+		}
+		if change != nil {
+			changes = append(changes, *change)
+		}
+		before.Reset()
+		after.Reset()
+		inHunk = false
+		return nil
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		switch {
+		case strings.HasPrefix(line, "diff "):
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		case !inHunk && strings.HasPrefix(line, "@@"):
+			inHunk = true
+		case !inHunk, line == "", strings.HasPrefix(line, `\`):
+		case line[0] == ' ':
+			before.WriteString(line[1:] + "\n")
+			after.WriteString(line[1:] + "\n")
+		case line[0] == '-':
+			before.WriteString(line[1:] + "\n")
+		case line[0] == '+':
+			after.WriteString(line[1:] + "\n")
+		}
+	}
+	return changes, flush()
+}
+
+// resourceChange compares the YAML of an object before and after, either
+// of which may be empty. It returns nil when they only differ in fields
+// the cluster maintains.
+func resourceChange(before, after []byte) (*plan.ResourceChange, error) {
+	beforeObjects, err := decodeObjects(before)
+	if err != nil {
+		return nil, err
+	}
+	afterObjects, err := decodeObjects(after)
+	if err != nil {
+		return nil, err
+	}
+	var b, a map[string]interface{}
+	for _, object := range beforeObjects {
+		b = object
+	}
+	for _, object := range afterObjects {
+		a = object
+	}
+	return objectChange(b, a), nil
+}
+
+// compareManifests compares the objects of two multi-document manifests by
+// kind, namespace and name.
+func compareManifests(before, after []byte) ([]plan.ResourceChange, error) {
+	beforeObjects, err := decodeObjects(before)
+	if err != nil {
+		return nil, err
+	}
+	afterObjects, err := decodeObjects(after)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]bool)
+	for key := range beforeObjects {
+		keys[key] = true
+	}
+	for key := range afterObjects {
+		keys[key] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	var changes []plan.ResourceChange
+	for _, key := range sorted {
+		if change := objectChange(beforeObjects[key], afterObjects[key]); change != nil {
+			changes = append(changes, *change)
+		}
+	}
+	return changes, nil
+}
+
+// decodeObjects decodes the objects of a YAML or JSON manifest by address.
+func decodeObjects(manifest []byte) (map[string]map[string]interface{}, error) {
+	objects := make(map[string]map[string]interface{})
+	decoder := utilyaml.NewYAMLOrJSONDecoder(bytes.NewReader(manifest), 4096)
+	for {
+		var object map[string]interface{}
+		err := decoder.Decode(&object)
+		if err == io.EOF {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error decoding manifest: %w", err)
+		}
+		if len(object) == 0 {
+			continue
+		}
+		normalize(object)
+		objects[objectAddress(object)] = object
+	}
+}
+
+// normalize drops the fields the cluster maintains from object.
+func normalize(object map[string]interface{}) {
+	delete(object, "status")
+	metadata, _ := object["metadata"].(map[string]interface{})
+	for _, field := range []string{"managedFields", "resourceVersion", "generation", "uid", "creationTimestamp"} {
+		delete(metadata, field)
+	}
+	annotations, _ := metadata["annotations"].(map[string]interface{})
+	delete(annotations, "kubectl.kubernetes.io/last-applied-configuration")
+	delete(annotations, "deployment.kubernetes.io/revision")
+	if annotations != nil && len(annotations) == 0 {
+		delete(metadata, "annotations")
+	}
+}
+
+// objectAddress returns Kind/namespace/name, or Kind/name without a
+// namespace.
+func objectAddress(object map[string]interface{}) string {
+	kind, _ := object["kind"].(string)
+	metadata, _ := object["metadata"].(map[string]interface{})
+	name, _ := metadata["name"].(string)
+	if namespace, _ := metadata["namespace"].(string); namespace != "" {
+		return kind + "/" + namespace + "/" + name
+	}
+	return kind + "/" + name
+}
+
+// objectChange returns the change from before to after, either of which may
+// be nil, or nil when they are equal.
+func objectChange(before, after map[string]interface{}) *plan.ResourceChange {
+	if reflect.DeepEqual(before, after) {
+		return nil
+	}
+	object := after
+	action := "update"
+	switch {
+	case before == nil:
+		action = "create"
+	case after == nil:
+		object, action = before, "delete"
+	}
+	kind, _ := object["kind"].(string)
+	metadata, _ := object["metadata"].(map[string]interface{})
+	name, _ := metadata["name"].(string)
+
+	change := plan.ResourceChange{Address: objectAddress(object), Mode: "managed", Type: kind, Name: name}
+	change.Change.Actions = []string{action}
+	// Keep nil maps as null, not as empty objects
+	if before != nil {
+		change.Change.Before = before
+	}
+	if after != nil {
+		change.Change.After = after
+	}
+	if kind == "Secret" {
+		sensitive := map[string]interface{}{"data": true, "stringData": true}
+		change.Change.BeforeSensitive = sensitive
+		change.Change.AfterSensitive = sensitive
+	}
+	return &change
+}
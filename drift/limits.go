@@ -0,0 +1,229 @@
+package drift
+
+import (
+	"atlantis-drift-detector/exporter"
+	"atlantis-drift-detector/report"
+	"context"
+	"regexp"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// throttlePattern matches plan output of cloud APIs rejecting requests for
+// coming too fast, e.g. AWS ThrottlingException or HTTP 429 Too Many
+// Requests.
+var throttlePattern = regexp.MustCompile(`(?i)throttl|rate exceeded|too many requests|requestlimitexceeded|rate limit`)
+
+// limits bound the plans running per account on top of the semaphore, see
+// UseLimits.
+var limits = struct {
+	sync.Mutex
+	// max is the limit of accounts without their own.
+	max      int
+	accounts map[string]int
+	byKey    map[string]*limiter
+}{max: 12, byKey: make(map[string]*limiter)}
+
+// UseLimits caps the plans running at the same time against each account,
+// the credential profile projects plan with, at accounts[account], or max
+// for accounts without a limit. Limits adapt while plans are throttled and
+// keep their state across calls.
+func UseLimits(max int, accounts map[string]int) {
+	limits.Lock()
+	defer limits.Unlock()
+	limits.max = max
+	limits.accounts = accounts
+	for account, l := range limits.byKey {
+		l.setMax(accountMax(account))
+	}
+}
+
+// accountMax returns the configured limit of account. The caller holds
+// limits.
+func accountMax(account string) int {
+	if n, ok := limits.accounts[account]; ok && n < limits.max {
+		return n
+	}
+	return limits.max
+}
+
+// limiterFor returns the limiter of account, creating it on first use.
+func limiterFor(account string) *limiter {
+	limits.Lock()
+	defer limits.Unlock()
+	l, ok := limits.byKey[account]
+	if !ok {
+		max := accountMax(account)
+		l = &limiter{account: account, max: max, limit: max, wake: make(chan struct{})}
+		limits.byKey[account] = l
+		exporter.SetConcurrencyLimit(account, max)
+	}
+	return l
+}
+
+// limiter is an adaptive concurrency limit. It halves when a plan is
+// throttled and grows by one again after as many unthrottled plans as the
+// limit allows, up to max.
+type limiter struct {
+	account   string
+	mu        sync.Mutex
+	max       int
+	limit     int
+	running   int
+	successes int
+	// wake is closed and replaced whenever a slot may have freed up.
+	wake chan struct{}
+}
+
+// acquire waits for a slot, or until ctx is cancelled.
+func (l *limiter) acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.running < l.limit {
+			l.running++
+			l.mu.Unlock()
+			return nil
+		}
+		wake := l.wake
+		l.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release frees a slot and adapts the limit to whether the plan holding it
+// was throttled.
+func (l *limiter) release(throttled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running--
+	switch {
+	case throttled:
+		exporter.CountThrottledPlan(l.account)
+		l.successes = 0
+		if l.limit > 1 {
+			l.limit /= 2
+			log.Warnf("plans of account %q are throttled, lowering its concurrency to %d", l.account, l.limit)
+		}
+	case l.limit < l.max:
+		l.successes++
+		if l.successes >= l.limit {
+			l.successes = 0
+			l.limit++
+			log.Infof("raising the concurrency of account %q to %d", l.account, l.limit)
+		}
+	}
+	exporter.SetConcurrencyLimit(l.account, l.limit)
+	l.signal()
+}
+
+// abort frees a slot whose plan never ran.
+func (l *limiter) abort() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running--
+	l.signal()
+}
+
+// setMax applies a new configured limit, which the current limit is
+// capped at.
+func (l *limiter) setMax(max int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit > max || l.limit == l.max {
+		l.limit = max
+	}
+	l.max = max
+	exporter.SetConcurrencyLimit(l.account, l.limit)
+	l.signal()
+}
+
+// signal wakes up waiting acquires. The caller holds l.mu.
+func (l *limiter) signal() {
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// slot is a plan's share of the limit of its account and of the semaphore.
+// Plans give it up while waiting to retry, so that waiting plans neither
+// hold up others nor count against a limit lowered by throttling.
+type slot struct {
+	limiter *limiter
+	held    bool
+	// paused counts the attempts whose throttling was already reported
+	// when giving the slot up.
+	paused int
+}
+
+// acquire waits until both the limiter and the semaphore have a free slot,
+// or until ctx is cancelled.
+func (s *slot) acquire(ctx context.Context) error {
+	err := s.limiter.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	select {
+	case semaphore <- struct{}{}: // Acquire
+	case <-ctx.Done():
+		s.limiter.abort()
+		return ctx.Err()
+	}
+	s.held = true
+	return nil
+}
+
+// release frees the slot and adapts the limit to whether the plan holding
+// it was throttled.
+func (s *slot) release(throttled bool) {
+	<-semaphore // Release
+	s.limiter.release(throttled)
+	s.held = false
+}
+
+// pause gives the slot up for delay after an attempt that was throttled or
+// not, and waits for it again. It returns an error when ctx was cancelled
+// meanwhile, the slot is then not held.
+func (s *slot) pause(ctx context.Context, delay time.Duration, throttled bool) error {
+	s.release(throttled)
+	s.paused++
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return s.acquire(ctx)
+}
+
+// withSlot runs plan once both the limiter of account and the semaphore
+// have a free slot, and adapts the limit to its output. It returns false
+// when ctx was cancelled first.
+func withSlot(ctx context.Context, account string, plan func(*slot) report.Result) (report.Result, bool) {
+	s := &slot{limiter: limiterFor(account)}
+	if s.acquire(ctx) != nil {
+		return report.Result{}, false
+	}
+	result := plan(s)
+	if s.held {
+		s.release(throttled(result, s.paused))
+	}
+	return result, true
+}
+
+// throttled reports whether the plan of result, or any of its attempts from
+// the first one on, was throttled.
+func throttled(result report.Result, first int) bool {
+	if first < len(result.Attempts) {
+		for _, attempt := range result.Attempts[first:] {
+			if attempt.Category == CategoryThrottling {
+				return true
+			}
+		}
+	}
+	return throttlePattern.MatchString(result.Output)
+}
@@ -0,0 +1,287 @@
+package drift
+
+import (
+	"atlantis-drift-detector/exporter"
+	"atlantis-drift-detector/flock"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// pluginCacheDir is where providers are cached between plans, see
+// UsePluginCache.
+var pluginCacheDir string
+
+// UsePluginCache shares downloaded providers between plans through dir,
+// which is kept across runs. Terragrunt plans use its provider cache in
+// dir/terragrunt. Terraform plans each get their own plugin cache, seeded
+// from the providers shared in dir/terraform and publishing the ones they
+// download there, so that concurrent inits never write to the same cache.
+// An empty dir makes every plan download its own providers.
+func UsePluginCache(dir string) {
+	if dir != "" {
+		// Plans run in their project, not in the working directory
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+	}
+	pluginCacheDir = dir
+}
+
+// pluginCacheEnv returns the variables pointing plans of runner at the
+// plugin cache. Terraform plans are pointed at theirs by planCache.
+func pluginCacheEnv(runner string) []string {
+	if pluginCacheDir == "" || runner == "terraform" {
+		return nil
+	}
+	// Terragrunt's provider cache server guards the cache itself, also
+	// during the inits Terragrunt runs to read dependency outputs
+	return []string{
+		"TERRAGRUNT_PROVIDER_CACHE=1",
+		"TERRAGRUNT_PROVIDER_CACHE_DIR=" + filepath.Join(pluginCacheDir, "terragrunt"),
+	}
+}
+
+// planCache is the plugin cache of a single Terraform plan. It holds hard
+// links to the shared providers, which Terraform never writes to with
+// TF_PLUGIN_CACHE_MAY_BREAK_DEPENDENCY_LOCK_FILE set, and the providers
+// the plan downloaded.
+type planCache struct {
+	dir string
+}
+
+// newPlanCache creates the plugin cache of a plan, nil when the plugin
+// cache is disabled or the plan's could not be created.
+func newPlanCache(project string) *planCache {
+	if pluginCacheDir == "" {
+		return nil
+	}
+	plans := filepath.Join(pluginCacheDir, "plans")
+	err := os.MkdirAll(plans, 0755)
+	if err != nil {
+		log.Warnf("error creating plugin cache of project %s, it downloads its own providers: %s", project, err)
+		return nil
+	}
+	dir, err := os.MkdirTemp(plans, "plan-")
+	if err != nil {
+		log.Warnf("error creating plugin cache of project %s, it downloads its own providers: %s", project, err)
+		return nil
+	}
+
+	// Providers are published whole, so every one seen is complete
+	err = linkTree(filepath.Join(pluginCacheDir, "terraform"), dir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("error seeding plugin cache of project %s: %s", project, err)
+	}
+	return &planCache{dir: dir}
+}
+
+// env returns the variables pointing Terraform at the cache.
+func (c *planCache) env() []string {
+	return []string{
+		"TF_PLUGIN_CACHE_DIR=" + c.dir,
+		// Plans never write lock files back, providers cached for another
+		// lock file are as good
+		"TF_PLUGIN_CACHE_MAY_BREAK_DEPENDENCY_LOCK_FILE=true",
+	}
+}
+
+// providerDepth is how deep providers are stored in a plugin cache, as
+// host/namespace/type/version/platform.
+const providerDepth = 5
+
+// publish adds the providers the plan downloaded to the shared cache. Each
+// one is linked into a temporary folder and renamed into place, which
+// fails without harm when another plan published it first.
+func (c *planCache) publish() {
+	unlock := lockPluginCache()
+	defer unlock()
+
+	shared := filepath.Join(pluginCacheDir, "terraform")
+	err := filepath.WalkDir(c.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(c.dir, path)
+		if err != nil || rel == "." || !entry.IsDir() || strings.Count(rel, string(filepath.Separator)) < providerDepth-1 {
+			return err
+		}
+
+		target := filepath.Join(shared, rel)
+		if _, err := os.Stat(target); err == nil {
+			return filepath.SkipDir
+		}
+		tmp, err := os.MkdirTemp(filepath.Join(pluginCacheDir, "plans"), "publish-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		err = linkTree(path, tmp)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(target), 0755)
+		}
+		if err == nil {
+			err = os.Rename(tmp, target)
+		}
+		if _, statErr := os.Stat(target); err != nil && statErr == nil {
+			// Published by a detector the lock does not reach
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		log.Debugf("published provider %s to the plugin cache", rel)
+		return filepath.SkipDir
+	})
+	if err != nil {
+		log.Warnf("error publishing providers to plugin cache %s: %s", shared, err)
+	}
+}
+
+// remove deletes the cache, once the plan no longer runs Terraform.
+func (c *planCache) remove() {
+	err := os.RemoveAll(c.dir)
+	if err != nil {
+		log.Warnf("error removing plugin cache %s: %s", c.dir, err)
+		exporter.CountCleanupError()
+	}
+}
+
+// linkTree recreates the folders of src in dest and hard links its files.
+func linkTree(src, dest string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		switch {
+		case entry.IsDir():
+			return os.MkdirAll(target, 0755)
+		case entry.Name() == ".lock":
+			return nil
+		case entry.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		}
+		return os.Link(path, target)
+	})
+}
+
+// pluginCacheMu serializes publishing within the detector, the file lock
+// across detectors sharing the cache.
+var pluginCacheMu sync.Mutex
+
+// lockPluginCache waits until no other plan is publishing providers to the
+// shared plugin cache, and returns the function releasing it.
+func lockPluginCache() func() {
+	pluginCacheMu.Lock()
+
+	dir := filepath.Join(pluginCacheDir, "terraform")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		log.Warnf("error creating plugin cache %s: %s", dir, err)
+		return pluginCacheMu.Unlock
+	}
+	file, err := os.OpenFile(filepath.Join(dir, ".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err == nil {
+		err = flock.Lock(file)
+	}
+	if err != nil {
+		log.Warnf("error locking plugin cache %s, only locking it within this process: %s", dir, err)
+		if file != nil {
+			file.Close()
+		}
+		return pluginCacheMu.Unlock
+	}
+	return func() {
+		flock.Unlock(file)
+		file.Close()
+		pluginCacheMu.Unlock()
+	}
+}
+
+// Terraform reports every provider init installs, and where from.
+var (
+	cacheHitPattern  = regexp.MustCompile(`(?m)^- Using \S+ v\S+ from the shared cache directory`)
+	cacheMissPattern = regexp.MustCompile(`(?m)^- Installing \S+ v\S+\.\.\.`)
+)
+
+// countPluginCacheUse records the providers init found in the plugin cache
+// and those it had to download, as reported in out.
+func countPluginCacheUse(out []byte) {
+	if pluginCacheDir == "" {
+		return
+	}
+	exporter.CountPluginCache(len(cacheHitPattern.FindAll(out, -1)), len(cacheMissPattern.FindAll(out, -1)))
+}
+
+// stalePlanCache is how old the cache of a plan must be to be left behind
+// by a detector that stopped while planning.
+const stalePlanCache = 24 * time.Hour
+
+// measurePluginCache removes the caches of plans that were left behind and
+// records the size of the plugin cache.
+func measurePluginCache() {
+	if pluginCacheDir == "" {
+		return
+	}
+	plans := filepath.Join(pluginCacheDir, "plans")
+	entries, _ := os.ReadDir(plans)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err == nil && time.Since(info.ModTime()) > stalePlanCache {
+			os.RemoveAll(filepath.Join(plans, entry.Name()))
+		}
+	}
+
+	var size int64
+	err := filepath.WalkDir(pluginCacheDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == plans {
+			// Only links to the shared providers and those being published
+			return filepath.SkipDir
+		}
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("error measuring plugin cache %s: %s", pluginCacheDir, err)
+		return
+	}
+	exporter.SetPluginCacheSize(size)
+}
+
+// cleanUp removes the working directory the plan of t initialized, which
+// only holds links into the plugin cache when it is enabled.
+func cleanUp(t target) {
+	cacheDir := ".terragrunt-cache"
+	if t.runner == "terraform" {
+		cacheDir = ".terraform"
+	}
+	err := os.RemoveAll(filepath.Join(t.dir, cacheDir))
+	if err != nil {
+		log.Warnf("error cleaning up %s of project %s: %s", cacheDir, t.project, err)
+		exporter.CountCleanupError()
+	}
+}
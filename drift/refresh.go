@@ -0,0 +1,59 @@
+package drift
+
+import (
+	"atlantis-drift-detector/plan"
+	"atlantis-drift-detector/report"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// refreshOnly enables refresh-only mode, see UseRefreshOnly.
+var refreshOnly bool
+
+// UseRefreshOnly makes planRun also run a refresh-only plan for every
+// project, so that changes made outside Terraform can be told apart from
+// code that was merged but never applied.
+func UseRefreshOnly(enabled bool) {
+	refreshOnly = enabled
+}
+
+// refreshPlanRun runs a refresh-only plan of t and returns its JSON
+// representation, whose resource_drift lists out-of-band changes.
+func refreshPlanRun(t target) (*plan.Plan, error) {
+	log.Debug("running refresh-only plan in " + t.project)
+	err := t.command("plan", "-refresh-only", "-lock=false", "-out=tfplan-refresh.out").Run()
+	if err != nil {
+		return nil, err
+	}
+	return showPlan(t, "tfplan-refresh.out")
+}
+
+// classifyDrift compares the changes of a normal plan with the drift found
+// by a refresh-only plan. Drifted resources explain the changes planned for
+// them, as Terraform wants to revert the drift; every other planned change
+// is code that was never applied.
+func classifyDrift(changes, drift []report.Change) string {
+	drifted := make(map[string]bool, len(drift))
+	for _, change := range drift {
+		drifted[change.Address] = true
+	}
+
+	unapplied := false
+	for _, change := range changes {
+		if !drifted[change.Address] {
+			unapplied = true
+			break
+		}
+	}
+
+	switch {
+	case len(drift) > 0 && unapplied:
+		return report.StatusOutOfBandUnapplied
+	case len(drift) > 0:
+		return report.StatusOutOfBand
+	case unapplied:
+		return report.StatusUnapplied
+	default:
+		return report.StatusNoChanges
+	}
+}
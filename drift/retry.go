@@ -0,0 +1,124 @@
+package drift
+
+import (
+	"atlantis-drift-detector/exporter"
+	"atlantis-drift-detector/report"
+	"math/rand"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Categories of transient plan errors.
+const (
+	CategoryRegistry   = "registry"
+	CategoryBackend    = "backend"
+	CategoryThrottling = "throttling"
+	CategoryNetwork    = "network"
+)
+
+// categoryPatterns classify the output of failed plans, the first match
+// wins.
+var categoryPatterns = []struct {
+	category string
+	pattern  *regexp.Regexp
+}{
+	{CategoryThrottling, throttlePattern},
+	{CategoryRegistry, regexp.MustCompile(`(?i)failed to query available provider packages|failed to install provider|could not retrieve the list of available versions|error accessing remote module registry`)},
+	{CategoryBackend, regexp.MustCompile(`(?i)error loading state|failed to get existing workspaces|error refreshing state|status ?code:? ?50[0234]\b|internal server error|bad gateway|service unavailable|gateway timeout`)},
+	{CategoryNetwork, regexp.MustCompile(`(?i)i/o timeout|connection reset by peer|connection refused|tls handshake timeout|no such host|unexpected eof|client\.timeout exceeded`)},
+}
+
+// retryPolicy decides which failed plans are retried, see UseRetry.
+var retryPolicy = struct {
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	retryable   map[string]bool
+}{maxAttempts: 1}
+
+// UseRetry plans projects up to maxAttempts times while they fail with an
+// error of one of categories. Retries wait backoff, doubled for every
+// further retry up to maxBackoff.
+func UseRetry(maxAttempts int, backoff, maxBackoff time.Duration, categories []string) {
+	retryPolicy.maxAttempts = maxAttempts
+	retryPolicy.backoff = backoff
+	retryPolicy.maxBackoff = maxBackoff
+	retryPolicy.retryable = make(map[string]bool, len(categories))
+	for _, category := range categories {
+		retryPolicy.retryable[category] = true
+	}
+}
+
+// classify returns the category of the error in the output of a failed
+// plan, empty when it is not a known transient error.
+func classify(output string) string {
+	for _, c := range categoryPatterns {
+		if c.pattern.MatchString(output) {
+			return c.category
+		}
+	}
+	return ""
+}
+
+// planWithRetries runs planRun until it succeeds, fails with an error that
+// is not retryable, or runs out of attempts. Every attempt is returned. The
+// plan's slot is given up while waiting to retry.
+func planWithRetries(t target) (planOutcome, []report.Attempt, error) {
+	var attempts []report.Attempt
+	for attempt := 1; ; attempt++ {
+		outcome, err := planRun(t)
+		if err == nil {
+			return outcome, append(attempts, report.Attempt{}), nil
+		}
+
+		category := classify(outcome.output)
+		attempts = append(attempts, report.Attempt{Error: lastLine(outcome.output, err), Category: category})
+		if attempt >= retryPolicy.maxAttempts || !retryPolicy.retryable[category] || t.ctx.Err() != nil {
+			return outcome, attempts, err
+		}
+
+		delay := retryDelay(attempt)
+		log.Infof("retrying project %s in %s after a %s error, attempt %d of %d", t.project, delay, category, attempt+1, retryPolicy.maxAttempts)
+		exporter.CountPlanRetry(category)
+		if t.slot == nil {
+			select {
+			case <-time.After(delay):
+			case <-t.ctx.Done():
+				return outcome, attempts, err
+			}
+			continue
+		}
+		if t.slot.pause(t.ctx, delay, category == CategoryThrottling) != nil {
+			return outcome, attempts, err
+		}
+	}
+}
+
+// retryDelay returns how long to wait before retrying after attempt, with
+// jitter so that projects failing together do not retry together.
+func retryDelay(attempt int) time.Duration {
+	delay := retryPolicy.backoff
+	for i := 1; i < attempt && delay < retryPolicy.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > retryPolicy.maxBackoff {
+		delay = retryPolicy.maxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// lastLine returns the last non-empty line of output, or err when there is
+// none.
+func lastLine(output string, err error) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if line := strings.TrimSpace(lines[len(lines)-1]); line != "" {
+		return line
+	}
+	return err.Error()
+}
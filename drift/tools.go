@@ -0,0 +1,255 @@
+package drift
+
+import (
+	"atlantis-drift-detector/versions"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// versionsDir holds the installed Terraform and Terragrunt versions, see
+// UseVersionsDir.
+var versionsDir string
+
+// UseVersionsDir plans every project with the Terraform and Terragrunt
+// versions it requires, picked from those installed in dir as
+// dir/terraform/<version>/terraform and dir/terragrunt/<version>/terragrunt.
+// The binaries on PATH count as installed too. An empty dir plans every
+// project with the binaries on PATH.
+func UseVersionsDir(dir string) {
+	if dir != "" {
+		// Plans run in their project, not in the working directory
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+	}
+	versionsDir = dir
+}
+
+var (
+	// requiredVersionPattern matches required_version in terraform blocks.
+	requiredVersionPattern = regexp.MustCompile(`\brequired_version\s*=\s*"([^"]+)"`)
+	// terragruntConstraintPattern matches terragrunt_version_constraint in
+	// terragrunt.hcl.
+	terragruntConstraintPattern = regexp.MustCompile(`\bterragrunt_version_constraint\s*=\s*"([^"]+)"`)
+	// versionOutputPattern finds the version in the output of --version.
+	versionOutputPattern = regexp.MustCompile(`\bv(\d+\.\d+\.\d+(?:-[0-9A-Za-z.-]+)?)`)
+)
+
+// tools are the binaries a project is planned with.
+type tools struct {
+	// bin is the runner's binary.
+	bin string
+	// env points Terragrunt at the Terraform binary.
+	env []string
+	// terraform and terragrunt are the versions used, empty when unknown.
+	terraform  string
+	terragrunt string
+}
+
+// use returns t planned with tools.
+func (t target) use(tools tools) target {
+	t.bin = tools.bin
+	t.env = append(t.env[:len(t.env):len(t.env)], tools.env...)
+	t.terraformVersion = tools.terraform
+	t.terragruntVersion = tools.terragrunt
+	return t
+}
+
+// atlantisVersions returns the terraform_version of every project in the
+// repo's atlantis.yaml, by project directory.
+func atlantisVersions(root string) map[string]string {
+	data, err := os.ReadFile(filepath.Join(root, "atlantis.yaml"))
+	if err != nil {
+		return nil
+	}
+	var atlantis struct {
+		Projects []struct {
+			Dir              string `yaml:"dir"`
+			TerraformVersion string `yaml:"terraform_version"`
+		} `yaml:"projects"`
+	}
+	err = yaml.Unmarshal(data, &atlantis)
+	if err != nil {
+		log.Warnf("error reading atlantis.yaml, ignoring its terraform versions: %v", err)
+		return nil
+	}
+	byDir := make(map[string]string)
+	for _, project := range atlantis.Projects {
+		if project.TerraformVersion != "" {
+			byDir[path.Clean(project.Dir)] = project.TerraformVersion
+		}
+	}
+	return byDir
+}
+
+// resolveTools picks the binaries the project rel of the repo checked out
+// at root is planned with. Terraform's version is required by atlantis, the
+// repo's atlantis.yaml, a .terraform-version file in the project or above,
+// or required_version, in that order. Terragrunt's by a .terragrunt-version
+// file or terragrunt_version_constraint in the nearest terragrunt.hcl.
+func resolveTools(root, rel, runner string, atlantis map[string]string) (tools, error) {
+	if versionsDir == "" {
+		tools := tools{bin: runner, terraform: defaultVersion("terraform")}
+		if runner != "terraform" {
+			tools.terragrunt = defaultVersion("terragrunt")
+		}
+		return tools, nil
+	}
+
+	requirement, ok := atlantis[rel]
+	if !ok {
+		requirement = versionFile(root, rel, ".terraform-version")
+	}
+	if requirement == "" {
+		requirement = requiredVersion(filepath.Join(root, rel))
+	}
+	terraformBin, terraformVersion, err := selectVersion("terraform", requirement)
+	if err != nil {
+		return tools{}, err
+	}
+	if runner == "terraform" {
+		return tools{bin: terraformBin, terraform: terraformVersion}, nil
+	}
+
+	requirement = versionFile(root, rel, ".terragrunt-version")
+	if requirement == "" {
+		requirement = nearestMatch(root, rel, "terragrunt.hcl", terragruntConstraintPattern)
+	}
+	terragruntBin, terragruntVersion, err := selectVersion("terragrunt", requirement)
+	if err != nil {
+		return tools{}, err
+	}
+	tools := tools{bin: terragruntBin, terraform: terraformVersion, terragrunt: terragruntVersion}
+	if terraformBin != "terraform" {
+		// Older Terragrunt versions read the first, newer ones the second
+		tools.env = []string{"TERRAGRUNT_TFPATH=" + terraformBin, "TG_TF_PATH=" + terraformBin}
+	}
+	return tools, nil
+}
+
+// versionFile returns the first line of the nearest file called name, in
+// the project rel or the folders above it up to root.
+func versionFile(root, rel, name string) string {
+	for dir := rel; ; dir = path.Dir(dir) {
+		data, err := os.ReadFile(filepath.Join(root, dir, name))
+		if err == nil {
+			line, _, _ := strings.Cut(string(data), "\n")
+			return strings.TrimSpace(line)
+		}
+		if dir == "." {
+			return ""
+		}
+	}
+}
+
+// nearestMatch returns the first group of pattern in the nearest file
+// called name, in the project rel or the folders above it up to root.
+func nearestMatch(root, rel, name string, pattern *regexp.Regexp) string {
+	for dir := rel; ; dir = path.Dir(dir) {
+		data, err := os.ReadFile(filepath.Join(root, dir, name))
+		if err == nil {
+			if match := pattern.FindSubmatch(data); match != nil {
+				return string(match[1])
+			}
+		}
+		if dir == "." {
+			return ""
+		}
+	}
+}
+
+// requiredVersion returns the required_version constraints of the .tf files
+// in dir, joined into one.
+func requiredVersion(dir string) string {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.tf"))
+	var constraints []string
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		for _, match := range requiredVersionPattern.FindAllSubmatch(data, -1) {
+			constraints = append(constraints, string(match[1]))
+		}
+	}
+	return strings.Join(constraints, ", ")
+}
+
+// selectVersion returns the binary and version of the highest installed
+// version of tool meeting requirement: a version constraint, latest, or
+// latest:<regexp> as in tfenv version files. Without a requirement it
+// returns the binary on PATH.
+func selectVersion(tool, requirement string) (string, string, error) {
+	if requirement == "" {
+		return tool, defaultVersion(tool), nil
+	}
+
+	var matches func(versions.Version) bool
+	switch {
+	case requirement == "latest":
+		matches = func(v versions.Version) bool { return v.Pre == "" }
+	case strings.HasPrefix(requirement, "latest:"):
+		pattern, err := regexp.Compile(strings.TrimPrefix(requirement, "latest:"))
+		if err != nil {
+			return "", "", fmt.Errorf("invalid %s version %q: %w", tool, requirement, err)
+		}
+		matches = func(v versions.Version) bool { return pattern.MatchString(v.String()) }
+	default:
+		constraints, err := versions.ParseConstraints(requirement)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid %s version %q: %w", tool, requirement, err)
+		}
+		matches = constraints.Check
+	}
+
+	for _, version := range versions.Installed(versionsDir, tool) {
+		if matches(version) {
+			return versions.Path(versionsDir, tool, version), version.String(), nil
+		}
+	}
+	// Installed versions win over the binary on PATH
+	if found, err := versions.Parse(defaultVersion(tool)); err == nil && matches(found) {
+		return tool, found.String(), nil
+	}
+	return "", "", fmt.Errorf("no installed %s version matches %q", tool, requirement)
+}
+
+// defaultVersions caches the versions of the binaries on PATH.
+var defaultVersions = struct {
+	sync.Mutex
+	byTool map[string]string
+}{byTool: make(map[string]string)}
+
+// defaultVersion returns the version of the binary of tool on PATH, empty
+// when it is missing or does not tell.
+func defaultVersion(tool string) string {
+	defaultVersions.Lock()
+	defer defaultVersions.Unlock()
+	version, ok := defaultVersions.byTool[tool]
+	if ok {
+		return version
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, tool, "--version").Output()
+	if err != nil {
+		log.Debugf("error getting the version of %s: %v", tool, err)
+	}
+	if match := versionOutputPattern.FindSubmatch(out); match != nil {
+		version = string(match[1])
+	}
+	defaultVersions.byTool[tool] = version
+	return version
+}
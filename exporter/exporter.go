@@ -31,15 +31,160 @@ var noChangesGauge = prometheus.NewGauge(
 	},
 )
 
+var blockedGauge = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "drift_detector_blocked_count",
+		Help: "Number of projects blocked by a failed upstream dependency in drift detector.",
+	},
+)
+
+var driftedBySeverityGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "drift_detector_drifted_by_severity_count",
+		Help: "Number of drifted projects in drift detector by severity.",
+	},
+	[]string{"severity"},
+)
+
+var driftedByKindGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "drift_detector_drifted_by_kind_count",
+		Help: "Number of drifted projects in drift detector by kind of drift, found in refresh-only mode.",
+	},
+	[]string{"kind"},
+)
+
+var configReloadErrors = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "drift_detector_config_reload_errors_total",
+		Help: "Number of config file versions rejected by drift detector.",
+	},
+)
+
+// CountConfigReloadError records a config file version that was rejected.
+func CountConfigReloadError() {
+	configReloadErrors.Inc()
+}
+
+var requeuedTasks = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "drift_detector_pool_requeued_tasks_total",
+		Help: "Number of tasks requeued because their worker stopped heartbeating.",
+	},
+)
+
+// CountRequeuedTask records a task taken away from a dead worker.
+func CountRequeuedTask() {
+	requeuedTasks.Inc()
+}
+
+var concurrencyLimitGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "drift_detector_concurrency_limit",
+		Help: "Number of plans allowed to run at the same time per account, lowered while throttled.",
+	},
+	[]string{"account"},
+)
+
+var throttledPlans = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "drift_detector_throttled_plans_total",
+		Help: "Number of plans whose output shows cloud API throttling, per account.",
+	},
+	[]string{"account"},
+)
+
+// SetConcurrencyLimit records the current concurrency limit of account.
+func SetConcurrencyLimit(account string, limit int) {
+	concurrencyLimitGauge.WithLabelValues(account).Set(float64(limit))
+}
+
+// CountThrottledPlan records a plan of account that was throttled.
+func CountThrottledPlan(account string) {
+	throttledPlans.WithLabelValues(account).Inc()
+}
+
+var planRetries = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "drift_detector_plan_retries_total",
+		Help: "Number of plans retried after a transient error, per error category.",
+	},
+	[]string{"category"},
+)
+
+// CountPlanRetry records a plan retried after an error of category.
+func CountPlanRetry(category string) {
+	planRetries.WithLabelValues(category).Inc()
+}
+
+var pluginCacheHits = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "drift_detector_plugin_cache_hits_total",
+		Help: "Number of providers plans found in the shared plugin cache.",
+	},
+)
+
+var pluginCacheMisses = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "drift_detector_plugin_cache_misses_total",
+		Help: "Number of providers plans downloaded into the shared plugin cache.",
+	},
+)
+
+var pluginCacheSize = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "drift_detector_plugin_cache_size_bytes",
+		Help: "Size of the shared plugin cache in bytes.",
+	},
+)
+
+var cleanupErrors = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "drift_detector_cleanup_errors_total",
+		Help: "Number of project working directories that could not be removed after planning.",
+	},
+)
+
+// CountPluginCache records the providers a plan found in the plugin cache
+// and those it downloaded.
+func CountPluginCache(hits, misses int) {
+	pluginCacheHits.Add(float64(hits))
+	pluginCacheMisses.Add(float64(misses))
+}
+
+// SetPluginCacheSize records the size of the plugin cache.
+func SetPluginCacheSize(bytes int64) {
+	pluginCacheSize.Set(float64(bytes))
+}
+
+// CountCleanupError records a working directory left behind by a plan.
+func CountCleanupError() {
+	cleanupErrors.Inc()
+}
+
 func init() {
 	prometheus.MustRegister(errorGauge)
 	prometheus.MustRegister(driftedGauge)
 	prometheus.MustRegister(noChangesGauge)
+	prometheus.MustRegister(blockedGauge)
+	prometheus.MustRegister(driftedBySeverityGauge)
+	prometheus.MustRegister(driftedByKindGauge)
+	prometheus.MustRegister(configReloadErrors)
+	prometheus.MustRegister(requeuedTasks)
+	prometheus.MustRegister(concurrencyLimitGauge)
+	prometheus.MustRegister(throttledPlans)
+	prometheus.MustRegister(planRetries)
+	prometheus.MustRegister(pluginCacheHits)
+	prometheus.MustRegister(pluginCacheMisses)
+	prometheus.MustRegister(pluginCacheSize)
+	prometheus.MustRegister(cleanupErrors)
 }
 
 func UpdateMetricsFromCSV(folderPath string) error {
 	// Initialize counters
-	var errorCount, driftedCount, noChangesCount float64
+	var errorCount, driftedCount, noChangesCount, blockedCount float64
+	bySeverity := make(map[string]float64)
+	byKind := make(map[string]float64)
 
 	// Read all files in the folder
 	files, err := ioutil.ReadDir(folderPath)
@@ -51,7 +196,7 @@ func UpdateMetricsFromCSV(folderPath string) error {
 		if strings.HasSuffix(file.Name(), ".csv") {
 			csvPath := filepath.Join(folderPath, file.Name())
 
-			errCount, driftCount, noChangeCount, err := processCSV(csvPath)
+			errCount, driftCount, noChangeCount, blockCount, err := processCSV(csvPath, bySeverity, byKind)
 			if err != nil {
 				return err
 			}
@@ -60,6 +205,7 @@ func UpdateMetricsFromCSV(folderPath string) error {
 			errorCount += errCount
 			driftedCount += driftCount
 			noChangesCount += noChangeCount
+			blockedCount += blockCount
 		}
 	}
 
@@ -67,33 +213,61 @@ func UpdateMetricsFromCSV(folderPath string) error {
 	errorGauge.Set(errorCount)
 	driftedGauge.Set(driftedCount)
 	noChangesGauge.Set(noChangesCount)
+	blockedGauge.Set(blockedCount)
+	driftedBySeverityGauge.Reset()
+	for level, count := range bySeverity {
+		driftedBySeverityGauge.WithLabelValues(level).Set(count)
+	}
+	driftedByKindGauge.Reset()
+	for kind, count := range byKind {
+		driftedByKindGauge.WithLabelValues(kind).Set(count)
+	}
 
 	return nil
 }
 
-func processCSV(filename string) (errorCount, driftedCount, noChangesCount float64, err error) {
+// processCSV counts the statuses in a report and adds drifted projects to
+// bySeverity, keyed by their severity, and to byKind, keyed by the kind of
+// drift found in refresh-only mode.
+func processCSV(filename string, bySeverity, byKind map[string]float64) (errorCount, driftedCount, noChangesCount, blockedCount float64, err error) {
 	file, err := os.Open(filename)
 	if err != nil {
-		return 0, 0, 0, err
+		return 0, 0, 0, 0, err
 	}
 	defer file.Close()
 
 	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
 	records, err := reader.ReadAll()
 	if err != nil {
-		return 0, 0, 0, err
+		return 0, 0, 0, 0, err
 	}
 
 	for _, record := range records {
+		switch record[1] {
+		case "out-of-band drift":
+			byKind["out-of-band"]++
+		case "unapplied code":
+			byKind["unapplied"]++
+		case "out-of-band drift and unapplied code":
+			byKind["out-of-band"]++
+			byKind["unapplied"]++
+		}
+
 		switch record[1] {
 		case "error":
 			errorCount++
-		case "drifted":
+		case "drifted", "out-of-band drift", "unapplied code", "out-of-band drift and unapplied code":
 			driftedCount++
+			if len(record) > 4 && record[4] != "" {
+				bySeverity[record[4]]++
+			}
 		case "No changes":
 			noChangesCount++
+		case "blocked":
+			blockedCount++
 		}
 	}
 
-	return errorCount, driftedCount, noChangesCount, nil
+	return errorCount, driftedCount, noChangesCount, blockedCount, nil
 }
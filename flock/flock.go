@@ -0,0 +1,4 @@
+// Package flock takes advisory locks on files, shared by every process
+// using the same file. They complement in-process mutexes when several
+// detectors share a volume.
+package flock
@@ -0,0 +1,22 @@
+//go:build !unix
+
+package flock
+
+import (
+	"errors"
+	"os"
+)
+
+var errUnsupported = errors.New("file locks are not supported on this platform")
+
+func Lock(file *os.File) error {
+	return errUnsupported
+}
+
+func TryLock(file *os.File) (bool, error) {
+	return false, errUnsupported
+}
+
+func Unlock(file *os.File) error {
+	return errUnsupported
+}
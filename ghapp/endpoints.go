@@ -0,0 +1,87 @@
+package ghapp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Endpoint holds the base URLs used to talk to a single GitHub host.
+type Endpoint struct {
+	// APIURL is the REST API base, e.g. https://ghe.example.com/api/v3.
+	APIURL string
+	// GitURL is the base that clone URLs are built from, e.g. https://ghe.example.com.
+	GitURL string
+}
+
+// Endpoints maps repo hosts, as they appear in allowlist entries, to the
+// endpoints of the GitHub instance serving them.
+type Endpoints map[string]Endpoint
+
+// NewEndpoints builds Endpoints from the API and git base URLs per host.
+// Hosts not mentioned in either map fall back to the defaults described on
+// For.
+func NewEndpoints(apiURLs, gitURLs map[string]string) Endpoints {
+	endpoints := make(Endpoints)
+	for host, url := range apiURLs {
+		endpoint := endpoints.For(host)
+		endpoint.APIURL = strings.TrimSuffix(url, "/")
+		endpoints[host] = endpoint
+	}
+	for host, url := range gitURLs {
+		endpoint := endpoints.For(host)
+		endpoint.GitURL = strings.TrimSuffix(url, "/")
+		endpoints[host] = endpoint
+	}
+	return endpoints
+}
+
+// For returns the endpoint configured for host. Unconfigured hosts use
+// api.github.com for github.com and the GitHub Enterprise Server layout
+// (https://host/api/v3) for everything else.
+func (e Endpoints) For(host string) Endpoint {
+	if endpoint, ok := e[host]; ok {
+		return endpoint
+	}
+	if host == "github.com" {
+		return Endpoint{APIURL: "https://api.github.com", GitURL: "https://github.com"}
+	}
+	return Endpoint{APIURL: "https://" + host + "/api/v3", GitURL: "https://" + host}
+}
+
+// CloneURL returns the HTTPS clone URL for org/repo on host.
+func (e Endpoints) CloneURL(host, org, repo string) string {
+	return e.For(host).GitURL + "/" + org + "/" + repo + ".git"
+}
+
+// NewHTTPClient returns an HTTP client that trusts the system roots plus, when
+// caBundleFile is set, every certificate in that PEM bundle.
+func NewHTTPClient(caBundleFile string) (*http.Client, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	if caBundleFile == "" {
+		return client, nil
+	}
+
+	pem, err := os.ReadFile(caBundleFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA bundle: %w", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", caBundleFile)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	client.Transport = transport
+
+	return client, nil
+}
@@ -0,0 +1,214 @@
+package ghapp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// refreshBefore is how long before expiry a cached installation token is
+// considered stale and gets refreshed.
+const refreshBefore = 5 * time.Minute
+
+type AuthTokenClaim struct {
+	*jwt.StandardClaims
+}
+
+type InstallationAuthResponse struct {
+	Token       string    `json:"token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Permissions struct {
+		Checks       string `json:"checks"`
+		Contents     string `json:"contents"`
+		Deployments  string `json:"deployments"`
+		Metadata     string `json:"metadata"`
+		PullRequests string `json:"pull_requests"`
+		Statuses     string `json:"statuses"`
+		Issues       string `json:"issues"`
+	} `json:"permissions"`
+	RepositorySelection string `json:"repository_selection"`
+}
+
+// TokenProvider hands out GitHub App installation tokens. Tokens are cached
+// per installation ID until shortly before they expire, so it is safe and
+// cheap to share a single provider between every feature that talks to GitHub.
+type TokenProvider struct {
+	appId     string
+	keyFile   string
+	endpoints Endpoints
+	client    *http.Client
+
+	// mu guards tokens, each token is requested under its own lock so
+	// that a slow request does not hold up other installations.
+	mu     sync.Mutex
+	tokens map[string]*cachedToken
+}
+
+// cachedToken is the token of one installation on one host.
+type cachedToken struct {
+	mu   sync.Mutex
+	auth *InstallationAuthResponse
+}
+
+// NewTokenProvider creates a provider for the GitHub App identified by appId,
+// signing its JWTs with the private key stored in keyFile. API requests for a
+// repo host are sent to the URL endpoints resolves for it, using client.
+func NewTokenProvider(appId, keyFile string, endpoints Endpoints, client *http.Client) *TokenProvider {
+	return &TokenProvider{
+		appId:     appId,
+		keyFile:   keyFile,
+		endpoints: endpoints,
+		client:    client,
+		tokens:    make(map[string]*cachedToken),
+	}
+}
+
+// Token returns a valid installation access token for installationId on the
+// given repo host, requesting a new one from GitHub only when the cached token
+// is missing or about to expire.
+func (p *TokenProvider) Token(host, installationId string) (string, error) {
+	cached := p.cached(host, installationId)
+	cached.mu.Lock()
+	defer cached.mu.Unlock()
+
+	if cached.auth != nil && time.Until(cached.auth.ExpiresAt) > refreshBefore {
+		return cached.auth.Token, nil
+	}
+
+	auth, err := p.requestToken(p.endpoints.For(host).APIURL, installationId)
+	if err != nil {
+		return "", err
+	}
+	cached.auth = auth
+	log.Debugf("refreshed github installation token for %s on %s, expires at %s", installationId, host, auth.ExpiresAt)
+
+	return auth.Token, nil
+}
+
+// Invalidate drops the cached token for installationId on host, e.g. after
+// GitHub rejected it.
+func (p *TokenProvider) Invalidate(host, installationId string) {
+	cached := p.cached(host, installationId)
+	cached.mu.Lock()
+	defer cached.mu.Unlock()
+	cached.auth = nil
+}
+
+// cached returns the cache entry of installationId on host.
+func (p *TokenProvider) cached(host, installationId string) *cachedToken {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := host + "/" + installationId
+	cached, ok := p.tokens[key]
+	if !ok {
+		cached = &cachedToken{}
+		p.tokens[key] = cached
+	}
+	return cached
+}
+
+func (p *TokenProvider) signJWT() (string, error) {
+	keyBytes, err := os.ReadFile(p.keyFile)
+	if err != nil {
+		return "", fmt.Errorf("error reading key: %w", err)
+	}
+
+	rsaPrivateKey, err := jwt.ParseRSAPrivateKeyFromPEM(keyBytes)
+	if err != nil {
+		return "", fmt.Errorf("error parsing RSA private key from pem: %w", err)
+	}
+
+	jwtToken := jwt.New(jwt.SigningMethodRS256)
+
+	// GitHub recommends backdating iat to allow for clock drift.
+	now := time.Now()
+	jwtToken.Claims = &AuthTokenClaim{
+		&jwt.StandardClaims{
+			IssuedAt:  now.Add(-1 * time.Minute).Unix(),
+			ExpiresAt: now.Add(5 * time.Minute).Unix(),
+			Issuer:    p.appId,
+		},
+	}
+
+	tokenString, err := jwtToken.SignedString(rsaPrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("error getting jwt token string: %w", err)
+	}
+
+	return tokenString, nil
+}
+
+func (p *TokenProvider) requestToken(apiURL, installationId string) (*InstallationAuthResponse, error) {
+	tokenString, err := p.signJWT()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", apiURL+"/app/installations/"+installationId+"/access_tokens", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making github api request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("github returned %s for installation %s: %s", res.Status, installationId, body)
+	}
+
+	var installationAuthResponse InstallationAuthResponse
+	err = json.NewDecoder(res.Body).Decode(&installationAuthResponse)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding auth response: %w", err)
+	}
+	if installationAuthResponse.Token == "" {
+		return nil, fmt.Errorf("github returned an empty token for installation %s", installationId)
+	}
+
+	return &installationAuthResponse, nil
+}
+
+// Installations maps GitHub organisations to App installation IDs.
+type Installations map[string]string
+
+// NewInstallations maps orgs, or host/org, to installation IDs. defaultID,
+// when set, is used for every other organisation.
+func NewInstallations(defaultID string, byOrg map[string]string) Installations {
+	installations := make(Installations)
+	for org, id := range byOrg {
+		installations[org] = id
+	}
+	if defaultID != "" {
+		installations[""] = defaultID
+	}
+	return installations
+}
+
+// For returns the installation ID to use for org on host. A host/org mapping
+// wins over a plain org mapping, which wins over the default installation.
+func (i Installations) For(host, org string) (string, error) {
+	if id, ok := i[host+"/"+org]; ok {
+		return id, nil
+	}
+	if id, ok := i[org]; ok {
+		return id, nil
+	}
+	if id, ok := i[""]; ok {
+		return id, nil
+	}
+	return "", fmt.Errorf("no github app installation configured for %s", org)
+}
@@ -0,0 +1,222 @@
+package ignore
+
+import (
+	"atlantis-drift-detector/config"
+	"atlantis-drift-detector/plan"
+	"atlantis-drift-detector/report"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// RepoFile is the name of the ignore file looked up at the root of every
+// scanned repository.
+const RepoFile = ".drift-ignore.yaml"
+
+// Rule describes a known and accepted drift. Address, Type and Projects
+// narrow down which resource changes the rule applies to. Without Attributes
+// matching changes are suppressed entirely, otherwise the listed attribute
+// paths are left out of the change, which is suppressed when nothing else
+// changed.
+type Rule struct {
+	// Address is a glob over resource addresses, e.g. module.asg.aws_autoscaling_group.*.
+	Address string `yaml:"address"`
+	// Type is a resource type, e.g. aws_autoscaling_group.
+	Type string `yaml:"type"`
+	// Attributes are dotted attribute paths where * matches a single
+	// segment, e.g. tags.* or desired_capacity.
+	Attributes []string `yaml:"attributes"`
+	// Projects are globs over project paths relative to the repository.
+	Projects []string `yaml:"projects"`
+	Reason   string   `yaml:"reason"`
+	// Expires is the date, as YYYY-MM-DD, after which the rule stops applying.
+	Expires string `yaml:"expires"`
+
+	expires time.Time
+}
+
+type Rules struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Load reads and merges the rules of every file that exists. Rules without a
+// valid expiry date are rejected and expired rules are dropped with a
+// warning.
+func Load(files ...string) (*Rules, error) {
+	merged := &Rules{}
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var rules Rules
+		err = yaml.UnmarshalStrict(data, &rules)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s: %w", file, err)
+		}
+
+		for i, rule := range rules.Rules {
+			if rule.Address == "" && rule.Type == "" {
+				return nil, fmt.Errorf("%s: rule %d needs an address or a type", file, i+1)
+			}
+			rule.expires, err = time.Parse("2006-01-02", rule.Expires)
+			if err != nil {
+				return nil, fmt.Errorf("%s: rule %d needs an expires date as YYYY-MM-DD", file, i+1)
+			}
+			if time.Now().After(rule.expires.AddDate(0, 0, 1)) {
+				log.Warnf("ignore rule %d in %s expired on %s", i+1, file, rule.Expires)
+				continue
+			}
+			merged.Rules = append(merged.Rules, rule)
+		}
+	}
+	return merged, nil
+}
+
+// Apply splits the resource changes of project into the ones that count as
+// drift and the ones suppressed by a rule. No-op changes are dropped.
+func (r *Rules) Apply(project string, changes []plan.ResourceChange) (kept, suppressed []report.Change) {
+	for i := range changes {
+		rc := &changes[i]
+		if rc.IsNoop() {
+			continue
+		}
+
+		change := report.Change{
+			Address:    rc.Address,
+			Type:       rc.Type,
+			Actions:    rc.Change.Actions,
+			Attributes: rc.ChangedAttributes(),
+		}
+
+		if rule := r.match(project, rc, change.Attributes); rule != nil {
+			change.Rule = rule.describe()
+			suppressed = append(suppressed, change)
+			continue
+		}
+		// Attributes ignored by rules covering only some of them are left
+		// out, the change is suppressed when the rules together cover all
+		remaining, rule := r.strip(project, rc, change.Attributes)
+		if rule != nil && len(remaining) == 0 {
+			change.Rule = rule.describe()
+			suppressed = append(suppressed, change)
+			continue
+		}
+		change.Attributes = remaining
+		kept = append(kept, change)
+	}
+	return kept, suppressed
+}
+
+// strip returns the attributes of rc no attribute rule ignores, and the
+// first rule that ignored any.
+func (r *Rules) strip(project string, rc *plan.ResourceChange, attributes []string) ([]string, *Rule) {
+	if r == nil || !isUpdate(rc) {
+		return attributes, nil
+	}
+	var first *Rule
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		if len(rule.Attributes) == 0 || !rule.appliesTo(project, rc) {
+			continue
+		}
+		var remaining []string
+		for _, attribute := range attributes {
+			if !rule.covers(attribute) {
+				remaining = append(remaining, attribute)
+			}
+		}
+		if len(remaining) < len(attributes) && first == nil {
+			first = rule
+		}
+		attributes = remaining
+	}
+	return attributes, first
+}
+
+// isUpdate reports whether rc is an in-place update, the only changes
+// attribute rules make sense for.
+func isUpdate(rc *plan.ResourceChange) bool {
+	return len(rc.Change.Actions) == 1 && rc.Change.Actions[0] == "update"
+}
+
+// match returns the first rule that suppresses rc entirely.
+func (r *Rules) match(project string, rc *plan.ResourceChange, attributes []string) *Rule {
+	if r == nil {
+		return nil
+	}
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		if !rule.appliesTo(project, rc) {
+			continue
+		}
+		if len(rule.Attributes) == 0 {
+			return rule
+		}
+		// Attribute rules only make sense for in-place updates
+		if !isUpdate(rc) || len(attributes) == 0 {
+			continue
+		}
+		if rule.coversAll(attributes) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (rule *Rule) appliesTo(project string, rc *plan.ResourceChange) bool {
+	if rule.Type != "" && rule.Type != rc.Type {
+		return false
+	}
+	if rule.Address != "" {
+		if ok, _ := path.Match(rule.Address, rc.Address); !ok {
+			return false
+		}
+	}
+	if len(rule.Projects) == 0 {
+		return true
+	}
+	for _, pattern := range rule.Projects {
+		if config.MatchGlob(pattern, project) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *Rule) coversAll(attributes []string) bool {
+	for _, attribute := range attributes {
+		if !rule.covers(attribute) {
+			return false
+		}
+	}
+	return true
+}
+
+func (rule *Rule) covers(attribute string) bool {
+	for _, pattern := range rule.Attributes {
+		if plan.MatchAttribute(pattern, attribute) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *Rule) describe() string {
+	description := rule.Reason
+	if description == "" {
+		description = "ignored"
+	}
+	return fmt.Sprintf("%s (until %s)", description, rule.Expires)
+}
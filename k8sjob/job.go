@@ -0,0 +1,138 @@
+package k8sjob
+
+import (
+	"atlantis-drift-detector/drift"
+	"path"
+	"regexp"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/rand"
+)
+
+// containerName is the container plans run in.
+const containerName = "plan"
+
+// Labels and annotations set on every Job.
+const (
+	appLabel          = "app.kubernetes.io/name"
+	componentLabel    = "app.kubernetes.io/component"
+	repoLabel         = "drift-detector/repo"
+	repoAnnotation    = "drift-detector/repo-url"
+	commitAnnotation  = "drift-detector/commit"
+	projectAnnotation = "drift-detector/projects"
+)
+
+// job returns the Job planning task.
+func (e *Executor) job(task drift.Task) *batchv1.Job {
+	args := []string{"run", "--once", "--repo", task.Repo.URL, "--output", "json", "--exit-code=false"}
+	if task.Commit != "" {
+		args = append(args, "--ref", "commit:"+task.Commit)
+	}
+	for _, project := range task.Projects {
+		args = append(args, "--project", project)
+	}
+
+	container := corev1.Container{
+		Name:  containerName,
+		Image: e.opts.Image,
+		Args:  args,
+		// The Job plans with the local executor, it must not start Jobs itself
+		Env:       []corev1.EnvVar{{Name: "DRIFT_DETECTOR_EXECUTOR", Value: "local"}},
+		Resources: e.opts.Resources,
+	}
+	for _, secret := range e.opts.Secrets {
+		container.EnvFrom = append(container.EnvFrom, corev1.EnvFromSource{
+			SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: secret}},
+		})
+	}
+
+	podSpec := corev1.PodSpec{
+		RestartPolicy:      corev1.RestartPolicyNever,
+		ServiceAccountName: e.serviceAccount(task),
+	}
+	if e.opts.ConfigMap != "" {
+		container.Args = append(container.Args, "--config", path.Join(ConfigDir, e.opts.ConfigKey))
+		container.VolumeMounts = []corev1.VolumeMount{{Name: "config", MountPath: ConfigDir, ReadOnly: true}}
+		podSpec.Volumes = []corev1.Volume{{
+			Name: "config",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: e.opts.ConfigMap}},
+			},
+		}}
+	}
+	podSpec.Containers = []corev1.Container{container}
+
+	labels := map[string]string{
+		appLabel:       "atlantis-drift-detector",
+		componentLabel: "plan",
+		repoLabel:      labelValue(task.Name),
+	}
+	backoffLimit := int32(0) // A failed plan is reported, not retried
+	deadline := int64(e.opts.Timeout.Seconds())
+	ttl := int32(e.opts.TTL.Seconds())
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			// Named here rather than through GenerateName, which fake
+			// clientsets do not implement
+			Name:      jobPrefix(task) + rand.String(5),
+			Namespace: e.opts.Namespace,
+			Labels:    labels,
+			Annotations: map[string]string{
+				repoAnnotation:    task.Repo.URL,
+				commitAnnotation:  task.Commit,
+				projectAnnotation: strings.Join(task.Projects, ","),
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            &backoffLimit,
+			ActiveDeadlineSeconds:   &deadline,
+			TTLSecondsAfterFinished: &ttl,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec:       podSpec,
+			},
+		},
+	}
+}
+
+// serviceAccount returns the service account of the single project of
+// task, falling back to the configured one. Repo wide Jobs always use the
+// configured one.
+func (e *Executor) serviceAccount(task drift.Task) string {
+	if len(task.Projects) == 1 {
+		if account := task.Repo.ProjectServiceAccount(task.Projects[0]); account != "" {
+			return account
+		}
+	}
+	return e.opts.ServiceAccount
+}
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// jobPrefix returns the name prefix of the Job of task, the repo and the
+// project it plans, shortened to leave room for a random suffix.
+func jobPrefix(task drift.Task) string {
+	name := "drift-" + task.Name
+	if len(task.Projects) == 1 {
+		name += "-" + task.Projects[0]
+	}
+	name = invalidNameChars.ReplaceAllString(strings.ToLower(name), "-")
+	if len(name) > 50 {
+		name = name[:50]
+	}
+	return strings.TrimRight(name, "-") + "-"
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// labelValue turns value into a valid label value.
+func labelValue(value string) string {
+	value = invalidLabelChars.ReplaceAllString(value, "-")
+	if len(value) > 63 {
+		value = value[:63]
+	}
+	return strings.Trim(value, "-_.")
+}
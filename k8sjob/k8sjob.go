@@ -0,0 +1,280 @@
+// Package k8sjob plans projects in Kubernetes Jobs. Each Job runs the
+// detector image in run --once mode against the commit being scanned and
+// prints its report to the pod logs, where the executor reads it back.
+package k8sjob
+
+import (
+	"atlantis-drift-detector/config"
+	"atlantis-drift-detector/drift"
+	"atlantis-drift-detector/pod"
+	"atlantis-drift-detector/report"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// Options describe the Jobs plans run in.
+type Options struct {
+	// Scope is drift.ScopeProject or drift.ScopeRepo.
+	Scope     string
+	Namespace string
+	Image     string
+	// ServiceAccount is used when the credential mapping of a project
+	// names none.
+	ServiceAccount string
+	// ConfigMap is mounted at ConfigDir, and ConfigKey is passed as the
+	// config file, when set.
+	ConfigMap string
+	ConfigKey string
+	Secrets   []string
+	Resources corev1.ResourceRequirements
+	// Timeout fails Jobs running longer, TTL deletes finished Jobs.
+	Timeout time.Duration
+	TTL     time.Duration
+	// PollInterval is how often Jobs are checked for completion.
+	PollInterval time.Duration
+}
+
+// ConfigDir is where the config map is mounted in Jobs.
+const ConfigDir = "/etc/drift-detector"
+
+// NewOptions turns cfg into Options. Without a namespace, Jobs are created
+// in the namespace of the detector's pod.
+func NewOptions(cfg config.KubernetesExecutorConfig) (Options, error) {
+	opts := Options{
+		Scope:          cfg.Scope,
+		Namespace:      cfg.Namespace,
+		Image:          cfg.Image,
+		ServiceAccount: cfg.ServiceAccount,
+		ConfigMap:      cfg.ConfigMap,
+		ConfigKey:      cfg.ConfigKey,
+		Secrets:        cfg.Secrets,
+		PollInterval:   5 * time.Second,
+	}
+	var err error
+	opts.Timeout, err = time.ParseDuration(cfg.Timeout)
+	if err != nil {
+		return opts, fmt.Errorf("invalid timeout: %w", err)
+	}
+	opts.TTL, err = time.ParseDuration(cfg.TTL)
+	if err != nil {
+		return opts, fmt.Errorf("invalid ttl: %w", err)
+	}
+	opts.Resources.Requests, err = resourceList(cfg.Resources.Requests)
+	if err != nil {
+		return opts, fmt.Errorf("invalid resource requests: %w", err)
+	}
+	opts.Resources.Limits, err = resourceList(cfg.Resources.Limits)
+	if err != nil {
+		return opts, fmt.Errorf("invalid resource limits: %w", err)
+	}
+
+	if opts.Namespace == "" {
+		opts.Namespace, err = pod.Namespace()
+		if err != nil {
+			return opts, fmt.Errorf("no namespace set and %w", err)
+		}
+	}
+	return opts, nil
+}
+
+func resourceList(quantities map[string]string) (corev1.ResourceList, error) {
+	if len(quantities) == 0 {
+		return nil, nil
+	}
+	list := make(corev1.ResourceList, len(quantities))
+	for name, value := range quantities {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		list[corev1.ResourceName(name)] = quantity
+	}
+	return list, nil
+}
+
+// NewInClusterClient returns a client authenticated as the detector's
+// service account.
+func NewInClusterClient() (kubernetes.Interface, error) {
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("error loading in-cluster config: %w", err)
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error creating kubernetes client: %w", err)
+	}
+	return clientset, nil
+}
+
+// Executor plans tasks in Jobs created through client.
+type Executor struct {
+	client kubernetes.Interface
+	opts   Options
+}
+
+// New returns an Executor creating Jobs through client, which may be a
+// fake clientset in tests.
+func New(client kubernetes.Interface, opts Options) *Executor {
+	return &Executor{client: client, opts: opts}
+}
+
+func (e *Executor) Scope() string {
+	return e.opts.Scope
+}
+
+// Run plans task in a Job and waits for it. Cancelling ctx deletes the Job.
+func (e *Executor) Run(ctx context.Context, task drift.Task) ([]report.Result, error) {
+	job, err := e.client.BatchV1().Jobs(e.opts.Namespace).Create(ctx, e.job(task), metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error creating job: %w", err)
+	}
+	name := job.Name
+	log.Infof("planning %s in job %s/%s", strings.Join(projectNames(task), ", "), e.opts.Namespace, name)
+
+	job, err = e.wait(ctx, name)
+	if err != nil {
+		e.delete(name)
+		return nil, err
+	}
+
+	logs, err := e.logs(ctx, name)
+	reason := failure(job)
+	switch {
+	case err != nil && reason != "":
+		return nil, fmt.Errorf("job %s failed: %s", name, reason)
+	case err != nil:
+		return nil, fmt.Errorf("error reading logs of job %s: %w", name, err)
+	}
+	results, found := parseResults(logs, task.Name)
+	switch {
+	case found:
+		return results, nil
+	case reason != "":
+		return nil, fmt.Errorf("job %s failed: %s\n%s", name, reason, tail(logs))
+	default:
+		return nil, fmt.Errorf("job %s printed no report for %s\n%s", name, task.Name, tail(logs))
+	}
+}
+
+// wait polls the Job until it completed or failed, or ctx is cancelled.
+func (e *Executor) wait(ctx context.Context, name string) (*batchv1.Job, error) {
+	ticker := time.NewTicker(e.opts.PollInterval)
+	defer ticker.Stop()
+	for {
+		job, err := e.client.BatchV1().Jobs(e.opts.Namespace).Get(ctx, name, metav1.GetOptions{})
+		switch {
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		case err != nil:
+			log.Warnf("error checking job %s: %v", name, err)
+		case finished(job):
+			return job, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// delete removes a Job together with its pods, which stops the plan.
+func (e *Executor) delete(name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	propagation := metav1.DeletePropagationBackground
+	err := e.client.BatchV1().Jobs(e.opts.Namespace).Delete(ctx, name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if err != nil {
+		log.Warnf("error deleting job %s: %v", name, err)
+	}
+}
+
+// logs returns the logs of the last pod of a Job.
+func (e *Executor) logs(ctx context.Context, name string) ([]byte, error) {
+	pods := e.client.CoreV1().Pods(e.opts.Namespace)
+	list, err := pods.List(ctx, metav1.ListOptions{LabelSelector: "job-name=" + name})
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Items) == 0 {
+		return nil, fmt.Errorf("no pod found")
+	}
+	pod := list.Items[0]
+	for _, item := range list.Items[1:] {
+		if item.CreationTimestamp.After(pod.CreationTimestamp.Time) {
+			pod = item
+		}
+	}
+	return pods.GetLogs(pod.Name, &corev1.PodLogOptions{Container: containerName}).DoRaw(ctx)
+}
+
+func finished(job *batchv1.Job) bool {
+	for _, condition := range job.Status.Conditions {
+		if (condition.Type == batchv1.JobComplete || condition.Type == batchv1.JobFailed) && condition.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// failure returns why a Job failed, empty when it did not.
+func failure(job *batchv1.Job) string {
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed && condition.Status == corev1.ConditionTrue {
+			return strings.TrimSpace(condition.Reason + " " + condition.Message)
+		}
+	}
+	return ""
+}
+
+// parseResults finds the JSON reports printed at the end of the logs and
+// returns the results of repo.
+func parseResults(logs []byte, repo string) ([]report.Result, bool) {
+	start := bytes.LastIndex(logs, []byte("\n[\n")) + 1
+	if start == 0 && !bytes.HasPrefix(logs, []byte("[\n")) {
+		return nil, false
+	}
+	var reports []*report.Report
+	err := json.NewDecoder(bytes.NewReader(logs[start:])).Decode(&reports)
+	if err != nil {
+		return nil, false
+	}
+	for _, repoReport := range reports {
+		if repoReport.Repo == repo {
+			return repoReport.Results, true
+		}
+	}
+	return nil, false
+}
+
+// outputLines is how much of the logs of a failed Job is kept.
+const outputLines = 50
+
+func tail(logs []byte) string {
+	lines := strings.Split(strings.TrimRight(string(logs), "\n"), "\n")
+	if len(lines) > outputLines {
+		lines = lines[len(lines)-outputLines:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func projectNames(task drift.Task) []string {
+	names := make([]string, len(task.Projects))
+	for i, project := range task.Projects {
+		names[i] = task.Name + "/" + project
+	}
+	return names
+}
@@ -0,0 +1,230 @@
+package k8sjob
+
+import (
+	"atlantis-drift-detector/config"
+	"atlantis-drift-detector/drift"
+	"atlantis-drift-detector/report"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const namespace = "drift"
+
+func testTask() drift.Task {
+	return drift.Task{
+		Repo:     config.RepoConfig{URL: "github.com/org/infra"},
+		Name:     "infra",
+		Commit:   "0123456789abcdef",
+		Projects: []string{"envs/prod"},
+	}
+}
+
+func testExecutor(client *fake.Clientset) *Executor {
+	return New(client, Options{
+		Scope:          drift.ScopeProject,
+		Namespace:      namespace,
+		Image:          "drift-detector:test",
+		ServiceAccount: "planner",
+		ConfigMap:      "drift-config",
+		ConfigKey:      "config.yaml",
+		Secrets:        []string{"cloud-credentials"},
+		Timeout:        time.Hour,
+		TTL:            10 * time.Minute,
+		PollInterval:   10 * time.Millisecond,
+	})
+}
+
+// finishJobs makes every Job created through client finish with condition,
+// and gives it a pod to read the logs of.
+func finishJobs(client *fake.Clientset, condition batchv1.JobCondition) {
+	client.PrependReactor("create", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		job := action.(k8stesting.CreateAction).GetObject().(*batchv1.Job)
+		job.Status.Conditions = append(job.Status.Conditions, condition)
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:      job.Name + "-pod",
+			Namespace: job.Namespace,
+			Labels:    map[string]string{"job-name": job.Name},
+		}}
+		// Handled by the tracker, which stores the updated Job
+		return false, nil, client.Tracker().Add(pod)
+	})
+}
+
+func createdJob(t *testing.T, client *fake.Clientset) batchv1.Job {
+	t.Helper()
+	jobs, err := client.BatchV1().Jobs(namespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs.Items) != 1 {
+		t.Fatalf("got %d jobs, want 1", len(jobs.Items))
+	}
+	return jobs.Items[0]
+}
+
+func TestJobSpec(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	finishJobs(client, batchv1.JobCondition{Type: batchv1.JobComplete, Status: corev1.ConditionTrue})
+
+	_, _ = testExecutor(client).Run(context.Background(), testTask())
+
+	job := createdJob(t, client)
+	if job.Namespace != namespace {
+		t.Errorf("namespace = %q, want %q", job.Namespace, namespace)
+	}
+	if !strings.HasPrefix(job.Name, "drift-infra-envs-prod-") {
+		t.Errorf("name = %q, want prefix drift-infra-envs-prod-", job.Name)
+	}
+	if *job.Spec.BackoffLimit != 0 {
+		t.Errorf("backoff limit = %d, want 0", *job.Spec.BackoffLimit)
+	}
+	if *job.Spec.ActiveDeadlineSeconds != 3600 || *job.Spec.TTLSecondsAfterFinished != 600 {
+		t.Errorf("deadline = %d, ttl = %d, want 3600 and 600", *job.Spec.ActiveDeadlineSeconds, *job.Spec.TTLSecondsAfterFinished)
+	}
+
+	pod := job.Spec.Template.Spec
+	if pod.RestartPolicy != corev1.RestartPolicyNever || pod.ServiceAccountName != "planner" {
+		t.Errorf("restart policy = %q, service account = %q", pod.RestartPolicy, pod.ServiceAccountName)
+	}
+	container := pod.Containers[0]
+	wantArgs := []string{
+		"run", "--once", "--repo", "github.com/org/infra", "--output", "json", "--exit-code=false",
+		"--ref", "commit:0123456789abcdef", "--project", "envs/prod",
+		"--config", "/etc/drift-detector/config.yaml",
+	}
+	if strings.Join(container.Args, " ") != strings.Join(wantArgs, " ") {
+		t.Errorf("args = %q, want %q", container.Args, wantArgs)
+	}
+	if len(container.Env) != 1 || container.Env[0].Name != "DRIFT_DETECTOR_EXECUTOR" || container.Env[0].Value != "local" {
+		t.Errorf("env = %v, want DRIFT_DETECTOR_EXECUTOR=local", container.Env)
+	}
+	if len(container.EnvFrom) != 1 || container.EnvFrom[0].SecretRef.Name != "cloud-credentials" {
+		t.Errorf("env from = %v, want secret cloud-credentials", container.EnvFrom)
+	}
+	if len(pod.Volumes) != 1 || pod.Volumes[0].ConfigMap.Name != "drift-config" {
+		t.Errorf("volumes = %v, want config map drift-config", pod.Volumes)
+	}
+	if job.Annotations[commitAnnotation] != "0123456789abcdef" || job.Annotations[projectAnnotation] != "envs/prod" {
+		t.Errorf("annotations = %v", job.Annotations)
+	}
+}
+
+func TestRunCompleted(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	finishJobs(client, batchv1.JobCondition{Type: batchv1.JobComplete, Status: corev1.ConditionTrue})
+
+	// The fake clientset returns "fake logs" for every pod, which hold no
+	// report
+	_, err := testExecutor(client).Run(context.Background(), testTask())
+	if err == nil || !strings.Contains(err.Error(), "printed no report for infra") {
+		t.Errorf("err = %v, want no report", err)
+	}
+	// Finished Jobs are left to their TTL
+	createdJob(t, client)
+}
+
+func TestRunFailed(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	finishJobs(client, batchv1.JobCondition{
+		Type:    batchv1.JobFailed,
+		Status:  corev1.ConditionTrue,
+		Reason:  "DeadlineExceeded",
+		Message: "Job was active longer than specified deadline",
+	})
+
+	_, err := testExecutor(client).Run(context.Background(), testTask())
+	want := "failed: DeadlineExceeded Job was active longer than specified deadline"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("err = %v, want %q", err, want)
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// The Job never finishes, cancelling deletes it
+	_, err := testExecutor(client).Run(ctx, testTask())
+	if err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	jobs, err := client.BatchV1().Jobs(namespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs.Items) != 0 {
+		t.Errorf("got %d jobs after cancelling, want 0", len(jobs.Items))
+	}
+}
+
+func TestRunLogsError(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		job := action.(k8stesting.CreateAction).GetObject().(*batchv1.Job)
+		job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Reason: "BackoffLimitExceeded"}}
+		return false, nil, nil
+	})
+
+	// Without a pod there are no logs, the failure is reported instead
+	_, err := testExecutor(client).Run(context.Background(), testTask())
+	if err == nil || !strings.HasSuffix(err.Error(), "failed: BackoffLimitExceeded") {
+		t.Errorf("err = %v, want BackoffLimitExceeded", err)
+	}
+}
+
+func TestParseResults(t *testing.T) {
+	logs := []byte(`time="2023-10-01T00:00:00Z" level=info msg="drifted project envs/prod"
+[
+  {
+    "Repo": "other",
+    "Commit": "",
+    "Results": []
+  },
+  {
+    "Repo": "infra",
+    "Commit": "0123456789abcdef",
+    "Results": [
+      {"Project": "envs/prod", "Status": "drifted", "Commit": "0123456789abcdef"}
+    ]
+  }
+]
+`)
+	results, found := parseResults(logs, "infra")
+	if !found {
+		t.Fatal("no results found")
+	}
+	if len(results) != 1 || results[0].Project != "envs/prod" || results[0].Status != report.StatusDrifted {
+		t.Errorf("results = %+v", results)
+	}
+
+	_, found = parseResults(logs, "missing")
+	if found {
+		t.Error("found results of a repo missing from the logs")
+	}
+	_, found = parseResults([]byte("error cloning repo\n"), "infra")
+	if found {
+		t.Error("found results in logs without a report")
+	}
+}
+
+func TestJobPrefix(t *testing.T) {
+	task := testTask()
+	task.Projects = []string{strings.Repeat("Very_Long/", 10)}
+	prefix := jobPrefix(task)
+	if len(prefix) > 51 || !strings.HasSuffix(prefix, "-") || strings.HasSuffix(prefix, "--") {
+		t.Errorf("prefix = %q", prefix)
+	}
+	if invalidNameChars.MatchString(strings.TrimSuffix(prefix, "-")) {
+		t.Errorf("prefix %q holds invalid characters", prefix)
+	}
+}
@@ -0,0 +1,188 @@
+package kubeconfig
+
+import (
+	"atlantis-drift-detector/config"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// Secrets reads kubeconfig sources stored in Secrets.
+type Secrets struct {
+	Client kubernetes.Interface
+	// Namespace is where Secrets named without a namespace are read from.
+	Namespace string
+}
+
+// Merge reads every source and merges them into a single kubeconfig. The
+// clusters, users and contexts of different sources may share a name only
+// when they are identical, every conflict is reported. The current context
+// is the first one a source sets.
+func Merge(ctx context.Context, sources []config.KubeconfigSource, secrets Secrets) (*clientcmdapi.Config, error) {
+	merged := clientcmdapi.NewConfig()
+	origins := make(map[string]string)
+	var errs []error
+
+	for _, source := range sources {
+		loaded, err := read(ctx, source, secrets)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range loaded {
+			if merged.CurrentContext == "" {
+				merged.CurrentContext = l.config.CurrentContext
+			}
+			errs = append(errs, mergeEntries("cluster", l.origin, l.config.Clusters, merged.Clusters, origins)...)
+			errs = append(errs, mergeEntries("user", l.origin, l.config.AuthInfos, merged.AuthInfos, origins)...)
+			errs = append(errs, mergeEntries("context", l.origin, l.config.Contexts, merged.Contexts, origins)...)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	// Contexts must only point at what the merged kubeconfig holds
+	for name, c := range merged.Contexts {
+		if _, ok := merged.Clusters[c.Cluster]; !ok {
+			errs = append(errs, fmt.Errorf("context %q of %s refers to unknown cluster %q", name, origins["context/"+name], c.Cluster))
+		}
+		if _, ok := merged.AuthInfos[c.AuthInfo]; c.AuthInfo != "" && !ok {
+			errs = append(errs, fmt.Errorf("context %q of %s refers to unknown user %q", name, origins["context/"+name], c.AuthInfo))
+		}
+	}
+	return merged, errors.Join(errs...)
+}
+
+// loaded is a kubeconfig and where it was read from.
+type loaded struct {
+	origin string
+	config *clientcmdapi.Config
+}
+
+// read loads the kubeconfigs of source, every file its path matches or the
+// key of its Secret.
+func read(ctx context.Context, source config.KubeconfigSource, secrets Secrets) ([]loaded, error) {
+	if source.Secret != "" {
+		namespace, name, found := strings.Cut(source.Secret, "/")
+		if !found {
+			namespace, name = secrets.Namespace, source.Secret
+		}
+		origin := "secret " + namespace + "/" + name
+		if secrets.Client == nil || namespace == "" {
+			return nil, fmt.Errorf("error reading %s: not running in a pod", origin)
+		}
+		secret, err := secrets.Client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", origin, err)
+		}
+		key := source.Key
+		if key == "" {
+			key = "config"
+		}
+		data, ok := secret.Data[key]
+		if !ok {
+			return nil, fmt.Errorf("error reading %s: no key %q", origin, key)
+		}
+		c, err := clientcmd.Load(data)
+		if err != nil {
+			return nil, fmt.Errorf("error loading kubeconfig from %s: %w", origin, err)
+		}
+		return []loaded{{origin: origin, config: c}}, nil
+	}
+
+	pattern, err := expandHome(source.Path)
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig path %q: %w", source.Path, err)
+	}
+	var configs []loaded
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading kubeconfig %s: %w", file, err)
+		}
+		c, err := clientcmd.Load(data)
+		if err != nil {
+			return nil, fmt.Errorf("error loading kubeconfig from %s: %w", file, err)
+		}
+		configs = append(configs, loaded{origin: file, config: c})
+	}
+	return configs, nil
+}
+
+// expandHome replaces a leading ~ of path with the home directory.
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("error expanding %s: %w", path, err)
+	}
+	return filepath.Join(home, strings.TrimPrefix(path, "~")), nil
+}
+
+// mergeEntries adds the entries of a kubeconfig read from origin to merged,
+// and returns an error for every one conflicting with an entry of the same
+// name from another source.
+func mergeEntries[T any](kind, origin string, entries, merged map[string]T, origins map[string]string) []error {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		key := kind + "/" + name
+		existing, ok := merged[name]
+		switch {
+		case !ok:
+			merged[name] = entries[name]
+			origins[key] = origin
+		case !reflect.DeepEqual(existing, entries[name]):
+			errs = append(errs, fmt.Errorf("%s %q of %s conflicts with the one of %s", kind, name, origin, origins[key]))
+		}
+	}
+	return errs
+}
+
+// Write stores c at path, replacing it atomically so that running commands
+// never read a partial file. The file is only readable by the detector, it
+// holds credentials.
+func Write(c *clientcmdapi.Config, path string) error {
+	data, err := clientcmd.Write(*c)
+	if err != nil {
+		return fmt.Errorf("error encoding kubeconfig: %w", err)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".kubeconfig-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
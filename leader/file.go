@@ -0,0 +1,56 @@
+package leader
+
+import (
+	"atlantis-drift-detector/flock"
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runFileLock elects the replica holding an exclusive lock on the lock file.
+// The lock is released by the operating system when the holder dies, so
+// followers poll for it. The leader writes its identity into the file.
+func runFileLock(ctx context.Context, opts Options, callbacks Callbacks) error {
+	if opts.LockFile == "" {
+		return fmt.Errorf("file leader election needs a lock file")
+	}
+	file, err := os.OpenFile(opts.LockFile, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening lock file: %w", err)
+	}
+	defer file.Close()
+
+	retry := opts.LeaseDuration / 7
+	for {
+		locked, err := flock.TryLock(file)
+		if err != nil {
+			return fmt.Errorf("error locking %s: %w", opts.LockFile, err)
+		}
+		if locked {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(retry):
+		}
+	}
+
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte(opts.Identity+"\n"), 0)
+	}
+	if err != nil {
+		log.Warnf("error writing identity to lock file: %s", err)
+	}
+
+	log.Infof("%s became the leader through lock file %s", opts.Identity, opts.LockFile)
+	callbacks.OnStarted(ctx)
+	<-ctx.Done()
+	log.Infof("%s stopped leading", opts.Identity)
+	callbacks.OnStopped()
+	return flock.Unlock(file)
+}
@@ -0,0 +1,72 @@
+package leader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Modes of leader election.
+const (
+	// ModeNone makes every replica the leader, for single replica setups.
+	ModeNone       = "none"
+	ModeKubernetes = "kubernetes"
+	ModeFile       = "file"
+)
+
+// Options configures leader election.
+type Options struct {
+	Mode string
+	// Identity names this replica, the hostname (pod name) when empty.
+	Identity string
+	// LeaseName and Namespace locate the Kubernetes Lease. The namespace
+	// defaults to the one of the pod's service account.
+	LeaseName string
+	Namespace string
+	// LockFile is the file locked in file mode, on storage shared by all
+	// replicas.
+	LockFile string
+	// LeaseDuration is how long a lease is valid without being renewed,
+	// followers take over at the latest this long after the leader died.
+	LeaseDuration time.Duration
+}
+
+// Callbacks are called when this replica gains and loses leadership.
+// OnStarted gets a context that is cancelled when leadership is lost.
+type Callbacks struct {
+	OnStarted func(ctx context.Context)
+	OnStopped func()
+}
+
+// Run campaigns for leadership until ctx is cancelled, calling callbacks
+// whenever this replica becomes or stops being the leader.
+func Run(ctx context.Context, opts Options, callbacks Callbacks) error {
+	if opts.Identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("error getting identity: %w", err)
+		}
+		opts.Identity = hostname
+	}
+	if opts.LeaseDuration <= 0 {
+		opts.LeaseDuration = 15 * time.Second
+	}
+
+	switch opts.Mode {
+	case "", ModeNone:
+		log.Info("leader election disabled, this replica schedules runs")
+		callbacks.OnStarted(ctx)
+		<-ctx.Done()
+		callbacks.OnStopped()
+		return nil
+	case ModeKubernetes:
+		return runLease(ctx, opts, callbacks)
+	case ModeFile:
+		return runFileLock(ctx, opts, callbacks)
+	default:
+		return fmt.Errorf("unknown leader election mode %q", opts.Mode)
+	}
+}
@@ -0,0 +1,72 @@
+package leader
+
+import (
+	"atlantis-drift-detector/pod"
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// runLease elects a leader with a Kubernetes Lease. After losing the lease
+// the replica campaigns again, so it can take over later.
+func runLease(ctx context.Context, opts Options, callbacks Callbacks) error {
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return fmt.Errorf("error loading in-cluster config: %w", err)
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return fmt.Errorf("error creating kubernetes client: %w", err)
+	}
+
+	namespace := opts.Namespace
+	if namespace == "" {
+		namespace, err = pod.Namespace()
+		if err != nil {
+			return fmt.Errorf("no namespace set and %w", err)
+		}
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: opts.LeaseName, Namespace: namespace},
+		Client:     clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: opts.Identity},
+	}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   opts.LeaseDuration,
+		RenewDeadline:   opts.LeaseDuration * 2 / 3,
+		RetryPeriod:     opts.LeaseDuration / 7,
+		ReleaseOnCancel: true,
+		Name:            opts.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Infof("%s became the leader through lease %s/%s", opts.Identity, namespace, opts.LeaseName)
+				callbacks.OnStarted(ctx)
+			},
+			OnStoppedLeading: func() {
+				log.Infof("%s stopped leading", opts.Identity)
+				callbacks.OnStopped()
+			},
+			OnNewLeader: func(identity string) {
+				if identity != opts.Identity {
+					log.Infof("%s is the leader", identity)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error configuring leader election: %w", err)
+	}
+
+	for ctx.Err() == nil {
+		elector.Run(ctx)
+	}
+	return nil
+}
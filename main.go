@@ -2,74 +2,129 @@ package main
 
 import (
 	"atlantis-drift-detector/config"
-	"atlantis-drift-detector/drift"
 	"atlantis-drift-detector/exporter"
+	"atlantis-drift-detector/leader"
+	"atlantis-drift-detector/report"
 	"atlantis-drift-detector/server"
+	"context"
+	"flag"
+	"fmt"
+	"os"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/robfig/cron/v3"
 	log "github.com/sirupsen/logrus"
 )
 
-var driftMutex sync.Mutex
-var isDriftRunning bool
+// configPollInterval is how often the config file is checked for changes.
+const configPollInterval = 10 * time.Second
+
+const usage = `Usage: atlantis-drift-detector [command] [flags]
+
+Commands:
+  serve      start the web server and scheduled drift runs (default)
+  run        run drift detection once: run --once [--repo X] [--project path] [--dry-run]
+             without --project or --dry-run the run replaces the stored reports
+             and incremental state and sends notifications, like a scheduled run
+  validate   check the config and the credentials of every repo
+  report     print the latest stored results: report [--format json|csv|md]
+  worker     plan tasks leased from a coordinator: worker [--coordinator url]
+
+Every command accepts --config, see "atlantis-drift-detector <command> -h".
+`
 
 func main() {
 
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		serve(args)
+	case "run":
+		os.Exit(runOnce(args))
+	case "validate":
+		os.Exit(validate(args))
+	case "report":
+		os.Exit(printReport(args))
+	case "worker":
+		os.Exit(work(args))
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
+}
+
+// flags returns the flag set of command with the --config flag every
+// command shares.
+func flags(command string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	// The config file is optional, environment variables override it
+	configFile := fs.String("config", config.GetEnvWithDefault("DRIFT_DETECTOR_CONFIG", ""), "path to the YAML config file")
+	return fs, configFile
+}
+
+func serve(args []string) {
+
 	log.SetFormatter(&log.JSONFormatter{})
 	log.Info("starting drift detector")
 
-	// Get environment variables
-	repoAllowlist, ghAppSlug, ghAppId, ghAppKeyFile, ghInstallationId, cronExpression, mergeKubeconfigs := config.InitEnvs()
+	fs, configFile := flags("serve")
+	fs.Parse(args)
 
-	// Merge kubeconfigs
-	if mergeKubeconfigs == "true" {
-		config.CreateKubeconfig()
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatalf("error loading config: %s", err)
+	}
+	rt, err := prepare(cfg)
+	if err != nil {
+		log.Fatalf("error loading config: %s", err)
 	}
+	d := newDetector(rt)
 
-	err := exporter.UpdateMetricsFromCSV("/csv/data")
+	err = exporter.UpdateMetricsFromCSV(report.Dir)
 	if err != nil {
 		log.Warnf("error reading CSV: %s", err)
 		return
 	}
 
-	// Start web server as a go routine
-	go server.Run()
-
-	// Schedule cron job to detect drift
-	c := cron.New()
-	_, err = c.AddFunc(cronExpression, func() {
-		driftMutex.Lock()
-
-		if isDriftRunning {
-			driftMutex.Unlock()
-			return
-		}
+	// Start web server as a go routine, serving the run queue
+	server.UseQueue(d.queue)
+	server.UsePool(coordinator)
+	go server.Run(cfg.Port)
 
-		isDriftRunning = true
-		driftMutex.Unlock()
-
-		log.Debug("running DetectDrift function")
-		drift.DetectDrift(strings.Split(repoAllowlist, ","), ghAppSlug, ghAppId, ghAppKeyFile, ghInstallationId)
-
-		driftMutex.Lock()
-		isDriftRunning = false
-		driftMutex.Unlock()
+	// Apply edits of the config file, e.g. a mounted ConfigMap, between runs
+	if *configFile != "" {
+		go config.Watch(*configFile, configPollInterval, d.reload, d.reject)
+	}
 
-		err := exporter.UpdateMetricsFromCSV("/csv/data")
-		if err != nil {
-			log.Warnf("error reading CSV: %s", err)
-			return
+	// Stored reports are shared, keep the metrics of followers current
+	go func() {
+		for range time.Tick(time.Minute) {
+			err := exporter.UpdateMetricsFromCSV(report.Dir)
+			if err != nil {
+				log.Warnf("error reading CSV: %s", err)
+			}
 		}
-		time.Sleep(1 * time.Hour)
-	})
+	}()
+
+	// Only the leader schedules and executes runs, every replica serves
+	// the UI and metrics
+	election := cfg.LeaderElection
+	leaseDuration, _ := time.ParseDuration(election.LeaseDuration)
+	err = leader.Run(context.Background(), leader.Options{
+		Mode:          election.Mode,
+		Identity:      election.Identity,
+		LeaseName:     election.LeaseName,
+		Namespace:     election.Namespace,
+		LockFile:      election.LockFile,
+		LeaseDuration: leaseDuration,
+	}, leader.Callbacks{OnStarted: d.lead, OnStopped: d.follow})
 	if err != nil {
-		log.Warnf("Error scheduling cron job: %s", err)
-		return
+		log.Fatalf("error running leader election: %s", err)
 	}
-	c.Start()
-
-	select {}
 }
@@ -1,35 +1,106 @@
 package notifier
 
 import (
-	"atlantis-drift-detector/config"
+	"atlantis-drift-detector/redact"
+	"atlantis-drift-detector/report"
+	"atlantis-drift-detector/severity"
 	"encoding/csv"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
+	"text/template"
 
 	"github.com/nlopes/slack"
 	log "github.com/sirupsen/logrus"
 )
 
-func Notify(repo string, driftedProjects []string, errorProjects []string, freshProjects []string) {
+// Sink delivers drift reports somewhere, e.g. to a Slack channel.
+type Sink interface {
+	Name() string
+	Send(repoReport *report.Report) error
+}
+
+type registeredSink struct {
+	sink        Sink
+	minSeverity string
+}
+
+var sinks []registeredSink
+
+// Register adds sink to the sinks every report is sent to. When minSeverity
+// is set, the sink only fires for reports with at least one drifted project
+// of that severity or above.
+func Register(sink Sink, minSeverity string) {
+	sinks = append(sinks, registeredSink{sink: sink, minSeverity: minSeverity})
+}
+
+// Reset removes every registered sink.
+func Reset() {
+	sinks = nil
+}
 
-	filePath, err := buildReportCSV(repo, driftedProjects, errorProjects, freshProjects)
+// Notify stores repoReport and sends it to the registered sinks named in
+// names, or to every sink when names is empty.
+func Notify(repoReport *report.Report, names []string) {
+
+	// Nothing leaves the detector before secrets are scrubbed
+	redact.Report(repoReport)
+
+	_, err := buildReportCSV(repoReport)
 	if err != nil {
 		log.Warn("could not build report")
 	}
 
-	slackChannel, slackToken := config.InitSlackEnvs()
-	err = sendReportToSlack(filePath, slackChannel, slackToken, repo, driftedProjects, errorProjects, freshProjects)
+	err = report.WriteJSON(report.JSONPath(repoReport.Repo), repoReport)
 	if err != nil {
-		log.Warnf("error sending slack message: %s", err)
-	} else {
-		log.Debug("report message was sent to slack")
+		log.Warnf("could not store detailed report: %s", err)
+	}
+
+	highest := highestSeverity(repoReport)
+	for _, s := range sinks {
+		if !selected(s.sink.Name(), names) {
+			continue
+		}
+		if s.minSeverity != "" && (highest == "" || !severity.AtLeast(highest, s.minSeverity)) {
+			log.Debugf("skipping %s notification, highest severity %q is below %s", s.sink.Name(), highest, s.minSeverity)
+			continue
+		}
+		err = s.sink.Send(repoReport)
+		if err != nil {
+			log.Warnf("error sending %s message: %s", s.sink.Name(), err)
+		} else {
+			log.Debugf("report message was sent to %s", s.sink.Name())
+		}
 	}
 }
 
-func buildReportCSV(repoFolder string, driftedProjects []string, errorProjects []string, freshProjects []string) (string, error) {
+func selected(name string, names []string) bool {
+	if len(names) == 0 {
+		return true
+	}
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func highestSeverity(repoReport *report.Report) string {
+	var highest string
+	for _, result := range repoReport.Results {
+		if report.IsDrift(result.Status) {
+			highest = severity.Max(highest, result.Severity)
+		}
+	}
+	return highest
+}
+
+func buildReportCSV(repoReport *report.Report) (string, error) {
 
 	log.Debug("building report csv")
-	filename := "csv/data/" + repoFolder + "_report.csv"
+	filename := report.CSVPath(repoReport.Repo)
 
 	// Create a CSV file.
 	file, err := os.Create(filename)
@@ -41,31 +112,28 @@ func buildReportCSV(repoFolder string, driftedProjects []string, errorProjects [
 
 	writer := csv.NewWriter(file)
 
-	// Write the data to the CSV file
-	for _, driftedProject := range driftedProjects {
-		row := []string{driftedProject, "drifted"}
-		err := writer.Write(row)
-		if err != nil {
-			log.Warnf("error writing data to CSV: %s", err)
-			return filename, err
-		}
-	}
+	// Most severe drift first
+	results := append([]report.Result(nil), repoReport.Results...)
+	sort.SliceStable(results, func(i, j int) bool {
+		return severity.Rank(results[i].Severity) > severity.Rank(results[j].Severity)
+	})
 
-	for _, errorProject := range errorProjects {
-		row := []string{errorProject, "error"}
-		err := writer.Write(row)
-		if err != nil {
-			log.Warnf("error writing data to CSV: %s", err)
-			return filename, err
-		}
+	// Write the data to the CSV file, grouped by status
+	statuses := []string{
+		report.StatusOutOfBandUnapplied, report.StatusOutOfBand, report.StatusUnapplied, report.StatusDrifted,
+		report.StatusError, report.StatusBlocked, report.StatusNoChanges,
 	}
-
-	for _, freshProject := range freshProjects {
-		row := []string{freshProject, "No changes"}
-		err := writer.Write(row)
-		if err != nil {
-			log.Warnf("error writing data to CSV: %s", err)
-			return filename, err
+	for _, status := range statuses {
+		for _, result := range results {
+			if result.Status != status {
+				continue
+			}
+			row := []string{result.Project, result.Status, result.Commit, result.BlockedBy, result.Severity}
+			err := writer.Write(row)
+			if err != nil {
+				log.Warnf("error writing data to CSV: %s", err)
+				return filename, err
+			}
 		}
 	}
 
@@ -76,7 +144,58 @@ func buildReportCSV(repoFolder string, driftedProjects []string, errorProjects [
 	return filename, nil
 }
 
-func sendReportToSlack(filePath, slackChannel, slackToken, repo string, driftedProjects, errorProjects, freshProjects []string) error {
+type slackSink struct {
+	channel string
+	token   string
+	message *template.Template
+}
+
+// NewSlackSink returns a sink posting a summary of each report to channel.
+// message is a text/template rendered with a Summary of the report.
+func NewSlackSink(channel, token, message string) (Sink, error) {
+	tmpl, err := template.New("slack").Parse(message)
+	if err != nil {
+		return nil, fmt.Errorf("invalid slack message template: %w", err)
+	}
+	return &slackSink{channel: channel, token: token, message: tmpl}, nil
+}
+
+func (s *slackSink) Name() string { return "slack" }
+
+func (s *slackSink) Send(repoReport *report.Report) error {
+	return sendReportToSlack(s.channel, s.token, s.message, repoReport)
+}
+
+// Summary is what notification templates are rendered with.
+type Summary struct {
+	Repo string
+	// Commit is the short sha the report was taken at.
+	Commit    string
+	Errors    int
+	Blocked   int
+	Drifted   int
+	NoChanges int
+	// Breakdown counts drifted projects by severity and kind, e.g.
+	// " (critical: 1, high: 2; out-of-band drift: 3)".
+	Breakdown string
+	Report    *report.Report
+}
+
+// NewSummary counts the results of repoReport by status.
+func NewSummary(repoReport *report.Report) Summary {
+	return Summary{
+		Repo:      repoReport.Repo,
+		Commit:    repoReport.ShortCommit(),
+		Errors:    len(repoReport.Projects(report.StatusError)),
+		Blocked:   len(repoReport.Projects(report.StatusBlocked)),
+		Drifted:   len(repoReport.Drifted()),
+		NoChanges: len(repoReport.Projects(report.StatusNoChanges)),
+		Breakdown: driftBreakdown(repoReport),
+		Report:    repoReport,
+	}
+}
+
+func sendReportToSlack(slackChannel, slackToken string, tmpl *template.Template, repoReport *report.Report) error {
 
 	if slackChannel == "" || slackToken == "" {
 		err := fmt.Errorf("slack channel or token not set")
@@ -86,16 +205,52 @@ func sendReportToSlack(filePath, slackChannel, slackToken, repo string, driftedP
 
 	api := slack.New(slackToken)
 
-	message := fmt.Sprintf("GM team!\nDrift report for `%s`\n:sos: Errors: %d\n:warning: Drifted: %d\n:white_check_mark: No changes: %d",
-		repo,
-		len(errorProjects),
-		len(driftedProjects),
-		len(freshProjects),
-	)
-	_, _, err := api.PostMessage(slackChannel, slack.MsgOptionText(message, false))
+	var message strings.Builder
+	err := tmpl.Execute(&message, NewSummary(repoReport))
+	if err != nil {
+		return fmt.Errorf("error rendering slack message: %w", err)
+	}
+	_, _, err = api.PostMessage(slackChannel, slack.MsgOptionText(message.String(), false))
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// driftBreakdown renders e.g. " (critical: 1, high: 2; out-of-band drift: 3)"
+// for drifted projects.
+func driftBreakdown(repoReport *report.Report) string {
+	counts := make(map[string]int)
+	for _, result := range repoReport.Results {
+		if report.IsDrift(result.Status) && result.Severity != "" {
+			counts[result.Severity]++
+		}
+	}
+
+	var parts []string
+	for _, level := range []string{severity.Critical, severity.High, severity.Medium, severity.Low} {
+		if counts[level] > 0 {
+			parts = append(parts, fmt.Sprintf("%s: %d", level, counts[level]))
+		}
+	}
+
+	var kinds []string
+	for _, status := range []string{report.StatusOutOfBand, report.StatusUnapplied, report.StatusOutOfBandUnapplied} {
+		if n := len(repoReport.Projects(status)); n > 0 {
+			kinds = append(kinds, fmt.Sprintf("%s: %d", status, n))
+		}
+	}
+
+	breakdown := strings.Join(parts, ", ")
+	if len(kinds) > 0 {
+		if breakdown != "" {
+			breakdown += "; "
+		}
+		breakdown += strings.Join(kinds, ", ")
+	}
+	if breakdown == "" {
+		return ""
+	}
+	return " (" + breakdown + ")"
+}
@@ -0,0 +1,190 @@
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Plan is the subset of `terraform show -json` output the detector uses.
+type Plan struct {
+	ResourceChanges []ResourceChange `json:"resource_changes"`
+	ResourceDrift   []ResourceChange `json:"resource_drift"`
+	PlannedValues   struct {
+		RootModule Module `json:"root_module"`
+	} `json:"planned_values"`
+}
+
+// Module is a module in the planned_values tree.
+type Module struct {
+	Resources []struct {
+		Address         string      `json:"address"`
+		SensitiveValues interface{} `json:"sensitive_values"`
+	} `json:"resources"`
+	ChildModules []Module `json:"child_modules"`
+}
+
+type ResourceChange struct {
+	Address       string `json:"address"`
+	ModuleAddress string `json:"module_address"`
+	Mode          string `json:"mode"`
+	Type          string `json:"type"`
+	Name          string `json:"name"`
+	Change        Change `json:"change"`
+}
+
+type Change struct {
+	Actions         []string    `json:"actions"`
+	Before          interface{} `json:"before"`
+	After           interface{} `json:"after"`
+	AfterUnknown    interface{} `json:"after_unknown"`
+	BeforeSensitive interface{} `json:"before_sensitive"`
+	AfterSensitive  interface{} `json:"after_sensitive"`
+}
+
+// Parse decodes the JSON representation of a saved plan.
+func Parse(data []byte) (*Plan, error) {
+	var p Plan
+	err := json.Unmarshal(data, &p)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding plan json: %w", err)
+	}
+	return &p, nil
+}
+
+// SensitiveValues returns the sensitive_values markers planned_values holds
+// for the resource at address, nil when there are none.
+func (p *Plan) SensitiveValues(address string) interface{} {
+	return p.PlannedValues.RootModule.sensitiveValues(address)
+}
+
+func (m *Module) sensitiveValues(address string) interface{} {
+	for _, resource := range m.Resources {
+		if resource.Address == address {
+			return resource.SensitiveValues
+		}
+	}
+	for i := range m.ChildModules {
+		if v := m.ChildModules[i].sensitiveValues(address); v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+// IsNoop reports whether the change leaves the resource untouched.
+func (rc *ResourceChange) IsNoop() bool {
+	for _, action := range rc.Change.Actions {
+		if action != "no-op" && action != "read" {
+			return false
+		}
+	}
+	return true
+}
+
+// ChangedAttributes returns the dotted paths, e.g. tags.Owner or
+// ingress.0.cidr_blocks, of every attribute whose value differs between
+// before and after or is only known after apply.
+func (rc *ResourceChange) ChangedAttributes() []string {
+	changed := make(map[string]bool)
+	diffValues("", rc.Change.Before, rc.Change.After, changed)
+	unknownPaths("", rc.Change.AfterUnknown, changed)
+
+	paths := make([]string, 0, len(changed))
+	for p := range changed {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// MatchAttribute matches a dotted attribute path against pattern segment by
+// segment, where * matches a single segment. A pattern also covers
+// everything nested below it, so tags matches tags.Owner.
+func MatchAttribute(pattern, attribute string) bool {
+	patternParts := strings.Split(pattern, ".")
+	attributeParts := strings.Split(attribute, ".")
+	if len(patternParts) > len(attributeParts) {
+		return false
+	}
+	for i, part := range patternParts {
+		if ok, _ := path.Match(part, attributeParts[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func join(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// diffValues records the paths of the leaves that differ between a and b.
+func diffValues(prefix string, a, b interface{}, changed map[string]bool) {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		for k := range av {
+			diffValues(join(prefix, k), av[k], bv[k], changed)
+		}
+		for k := range bv {
+			if _, seen := av[k]; !seen {
+				diffValues(join(prefix, k), nil, bv[k], changed)
+			}
+		}
+		return
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < len(av) || i < len(bv); i++ {
+			var x, y interface{}
+			if i < len(av) {
+				x = av[i]
+			}
+			if i < len(bv) {
+				y = bv[i]
+			}
+			diffValues(join(prefix, strconv.Itoa(i)), x, y, changed)
+		}
+		return
+	}
+
+	if !equal(a, b) && prefix != "" {
+		changed[prefix] = true
+	}
+}
+
+// unknownPaths records the paths marked true in an after_unknown structure.
+func unknownPaths(prefix string, unknown interface{}, changed map[string]bool) {
+	switch u := unknown.(type) {
+	case bool:
+		if u && prefix != "" {
+			changed[prefix] = true
+		}
+	case map[string]interface{}:
+		for k, v := range u {
+			unknownPaths(join(prefix, k), v, changed)
+		}
+	case []interface{}:
+		for i, v := range u {
+			unknownPaths(join(prefix, strconv.Itoa(i)), v, changed)
+		}
+	}
+}
+
+func equal(a, b interface{}) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return string(x) == string(y)
+}
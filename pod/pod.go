@@ -0,0 +1,20 @@
+// Package pod reads what Kubernetes tells the detector's pod about itself.
+package pod
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// serviceAccountNamespace is where Kubernetes mounts the pod's namespace.
+const serviceAccountNamespace = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// Namespace returns the namespace of the detector's pod.
+func Namespace() (string, error) {
+	data, err := os.ReadFile(serviceAccountNamespace)
+	if err != nil {
+		return "", fmt.Errorf("not running in a pod: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
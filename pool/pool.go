@@ -0,0 +1,308 @@
+// Package pool spreads plans over workers. The coordinator queues a task per
+// project and waits for its result, workers lease tasks over HTTP, keep
+// their lease alive with heartbeats and post the results back. Tasks of
+// workers that stop heartbeating are requeued.
+package pool
+
+import (
+	"atlantis-drift-detector/drift"
+	"atlantis-drift-detector/exporter"
+	"atlantis-drift-detector/report"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrUnavailable is returned while the pool does not coordinate workers,
+// e.g. because another replica is the leader.
+var ErrUnavailable = errors.New("workers are coordinated by another replica")
+
+// ErrLeaseLost is returned for tasks that are no longer leased to the
+// worker, because they were requeued, cancelled or completed.
+var ErrLeaseLost = errors.New("task is not leased to this worker")
+
+// Task is a set of projects of a repo for a worker to plan.
+type Task struct {
+	ID string `json:"id"`
+	// Repo is the url of the repo in the config.
+	Repo string `json:"repo"`
+	// Name is the folder the repo is reported under.
+	Name     string   `json:"name"`
+	Commit   string   `json:"commit,omitempty"`
+	Projects []string `json:"projects"`
+	// Attempt counts the leases of the task, starting at 1.
+	Attempt int `json:"attempt"`
+	// LeaseSeconds is how long the lease lasts without heartbeat.
+	LeaseSeconds int `json:"lease_seconds"`
+}
+
+// Status describes a queued or leased task.
+type Status struct {
+	Task
+	Worker  string     `json:"worker,omitempty"`
+	Expires *time.Time `json:"lease_expires_at,omitempty"`
+}
+
+type task struct {
+	Task
+	// seq orders tasks by the time they were queued.
+	seq     int
+	worker  string
+	expires time.Time
+	done    chan outcome
+}
+
+type outcome struct {
+	results []report.Result
+	err     error
+}
+
+// Pool queues tasks for workers and implements drift.Executor on the
+// coordinator.
+type Pool struct {
+	mu          sync.Mutex
+	open        bool
+	lease       time.Duration
+	maxAttempts int
+	tasks       map[string]*task
+	pending     []*task
+	// ready is closed and replaced whenever a task is queued or the pool
+	// closes, waking up waiting leases.
+	ready  chan struct{}
+	nextID int
+	reaper sync.Once
+}
+
+// New returns a closed pool, see Open.
+func New() *Pool {
+	return &Pool{
+		lease:       30 * time.Second,
+		maxAttempts: 3,
+		tasks:       make(map[string]*task),
+		ready:       make(chan struct{}),
+	}
+}
+
+// UseLease sets how long leases last without heartbeat and how often a
+// task is leased before it fails.
+func (p *Pool) UseLease(duration time.Duration, maxAttempts int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lease = duration
+	p.maxAttempts = maxAttempts
+}
+
+// Open starts handing out tasks, once this replica coordinates workers.
+func (p *Pool) Open() {
+	p.mu.Lock()
+	p.open = true
+	p.mu.Unlock()
+	p.reaper.Do(func() { go p.reap() })
+}
+
+// Close stops handing out tasks. Tasks keep their leases until the runs
+// they belong to are cancelled.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.open = false
+	p.wake()
+}
+
+func (p *Pool) Scope() string {
+	return drift.ScopeProject
+}
+
+// Run queues t and waits for a worker to plan it. Cancelling ctx withdraws
+// the task, the worker planning it is told by its next heartbeat.
+func (p *Pool) Run(ctx context.Context, t drift.Task) ([]report.Result, error) {
+	p.mu.Lock()
+	if !p.open {
+		p.mu.Unlock()
+		return nil, ErrUnavailable
+	}
+	p.nextID++
+	tk := &task{
+		Task: Task{
+			ID:       fmt.Sprintf("%d-%d", time.Now().Unix(), p.nextID),
+			Repo:     t.Repo.URL,
+			Name:     t.Name,
+			Commit:   t.Commit,
+			Projects: t.Projects,
+		},
+		seq:  p.nextID,
+		done: make(chan outcome, 1),
+	}
+	p.tasks[tk.ID] = tk
+	p.pending = append(p.pending, tk)
+	p.wake()
+	p.mu.Unlock()
+
+	select {
+	case out := <-tk.done:
+		return out.results, out.err
+	case <-ctx.Done():
+		p.mu.Lock()
+		p.remove(tk)
+		p.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// Lease hands the oldest queued task to worker, waiting for one until ctx
+// is done. It returns nil when no task was queued in time.
+func (p *Pool) Lease(ctx context.Context, worker string) (*Task, error) {
+	for {
+		p.mu.Lock()
+		if !p.open {
+			p.mu.Unlock()
+			return nil, ErrUnavailable
+		}
+		if len(p.pending) > 0 {
+			tk := p.pending[0]
+			p.pending = p.pending[1:]
+			tk.worker = worker
+			tk.expires = time.Now().Add(p.lease)
+			tk.Attempt++
+			tk.LeaseSeconds = int(p.lease.Seconds())
+			leased := tk.Task
+			p.mu.Unlock()
+			log.Infof("leased task %s of %s to worker %s, attempt %d", leased.ID, leased.Name, worker, leased.Attempt)
+			return &leased, nil
+		}
+		ready := p.ready
+		p.mu.Unlock()
+
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, nil
+		}
+	}
+}
+
+// Heartbeat extends the lease of worker on task id.
+func (p *Pool) Heartbeat(id, worker string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tk, err := p.leased(id, worker)
+	if err != nil {
+		return err
+	}
+	tk.expires = time.Now().Add(p.lease)
+	return nil
+}
+
+// Complete hands the results of task id, or the error planning it, to the
+// run waiting for them.
+func (p *Pool) Complete(id, worker string, results []report.Result, planErr error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tk, err := p.leased(id, worker)
+	if err != nil {
+		return err
+	}
+	p.remove(tk)
+	tk.done <- outcome{results: results, err: planErr}
+	return nil
+}
+
+// Release requeues task id, e.g. because its worker is shutting down. It
+// does not count as an attempt.
+func (p *Pool) Release(id, worker string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tk, err := p.leased(id, worker)
+	if err != nil {
+		return err
+	}
+	log.Infof("worker %s released task %s of %s", worker, id, tk.Name)
+	tk.Attempt--
+	p.requeue(tk)
+	return nil
+}
+
+// List returns the queued and leased tasks, oldest first.
+func (p *Pool) List() []Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tasks := make([]*task, 0, len(p.tasks))
+	for _, tk := range p.tasks {
+		tasks = append(tasks, tk)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].seq < tasks[j].seq })
+
+	statuses := make([]Status, len(tasks))
+	for i, tk := range tasks {
+		statuses[i] = Status{Task: tk.Task, Worker: tk.worker}
+		if tk.worker != "" {
+			expires := tk.expires
+			statuses[i].Expires = &expires
+		}
+	}
+	return statuses
+}
+
+// leased returns task id when it is leased to worker. The caller holds
+// p.mu.
+func (p *Pool) leased(id, worker string) (*task, error) {
+	tk, ok := p.tasks[id]
+	if !ok || tk.worker == "" || tk.worker != worker {
+		return nil, ErrLeaseLost
+	}
+	return tk, nil
+}
+
+// requeue puts a leased task back at the front of the queue. The caller
+// holds p.mu.
+func (p *Pool) requeue(tk *task) {
+	tk.worker = ""
+	p.pending = append([]*task{tk}, p.pending...)
+	p.wake()
+}
+
+// remove forgets a task, queued or leased. The caller holds p.mu.
+func (p *Pool) remove(tk *task) {
+	delete(p.tasks, tk.ID)
+	for i, pending := range p.pending {
+		if pending == tk {
+			p.pending = append(p.pending[:i], p.pending[i+1:]...)
+			break
+		}
+	}
+}
+
+// wake wakes up waiting leases. The caller holds p.mu.
+func (p *Pool) wake() {
+	close(p.ready)
+	p.ready = make(chan struct{})
+}
+
+// reap requeues the tasks of workers that stopped heartbeating, and fails
+// those that ran out of attempts.
+func (p *Pool) reap() {
+	for range time.Tick(time.Second) {
+		p.mu.Lock()
+		now := time.Now()
+		for _, tk := range p.tasks {
+			if tk.worker == "" || now.Before(tk.expires) {
+				continue
+			}
+			if tk.Attempt >= p.maxAttempts {
+				log.Warnf("worker %s stopped heartbeating, task %s of %s failed after %d attempts", tk.worker, tk.ID, tk.Name, tk.Attempt)
+				p.remove(tk)
+				tk.done <- outcome{err: fmt.Errorf("task %s lost its worker %d times", tk.ID, tk.Attempt)}
+				continue
+			}
+			log.Warnf("worker %s stopped heartbeating, requeueing task %s of %s", tk.worker, tk.ID, tk.Name)
+			exporter.CountRequeuedTask()
+			p.requeue(tk)
+		}
+		p.mu.Unlock()
+	}
+}
@@ -0,0 +1,216 @@
+package pool
+
+import (
+	"atlantis-drift-detector/report"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Update is what workers send the coordinator: the worker's identity, and
+// with a completed task its results or the error planning it.
+type Update struct {
+	Worker  string          `json:"worker"`
+	Results []report.Result `json:"results,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// Client talks to the tasks API of a coordinator.
+type Client struct {
+	url   string
+	token string
+	http  *http.Client
+}
+
+// pollTimeout bounds a lease request, which the coordinator holds open
+// until a task is queued.
+const pollTimeout = time.Minute
+
+// NewClient returns a client of the coordinator at baseURL, authenticating
+// with token when set. Requests use the transport of httpClient.
+func NewClient(baseURL, token string, httpClient *http.Client) *Client {
+	return &Client{
+		url:   strings.TrimSuffix(baseURL, "/") + "/drift-detector/api/tasks",
+		token: token,
+		http:  &http.Client{Transport: httpClient.Transport, Timeout: pollTimeout},
+	}
+}
+
+// Lease asks for a task for worker, nil when none was queued in time.
+func (c *Client) Lease(ctx context.Context, worker string) (*Task, error) {
+	var task Task
+	found, err := c.post(ctx, "/lease", Update{Worker: worker}, &task)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// Heartbeat extends the lease of worker on task id.
+func (c *Client) Heartbeat(ctx context.Context, id, worker string) error {
+	_, err := c.post(ctx, "/"+url.PathEscape(id)+"/heartbeat", Update{Worker: worker}, nil)
+	return err
+}
+
+// Complete sends the results of task id, or the error planning it.
+func (c *Client) Complete(ctx context.Context, id, worker string, results []report.Result, planErr error) error {
+	update := Update{Worker: worker, Results: results}
+	if planErr != nil {
+		update.Error = planErr.Error()
+	}
+	_, err := c.post(ctx, "/"+url.PathEscape(id)+"/result", update, nil)
+	return err
+}
+
+// Release hands task id back to be planned by another worker.
+func (c *Client) Release(ctx context.Context, id, worker string) error {
+	_, err := c.post(ctx, "/"+url.PathEscape(id)+"/release", Update{Worker: worker}, nil)
+	return err
+}
+
+// post sends body to path and decodes the response into out. It returns
+// false when the coordinator answered without content.
+func (c *Client) post(ctx context.Context, path string, body interface{}, out interface{}) (bool, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+path, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return false, nil
+	case resp.StatusCode == http.StatusConflict:
+		return false, ErrLeaseLost
+	case resp.StatusCode == http.StatusServiceUnavailable:
+		return false, ErrUnavailable
+	case resp.StatusCode != http.StatusOK:
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return false, fmt.Errorf("coordinator answered %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	case out == nil:
+		return true, nil
+	}
+	return true, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Planner plans the projects of a task and returns their results.
+type Planner func(ctx context.Context, task Task) ([]report.Result, error)
+
+// retryInterval is how long workers wait after the coordinator could not be
+// reached, or while it does not coordinate workers.
+const retryInterval = 5 * time.Second
+
+// Work leases tasks for worker from client and plans them with plan, slots
+// at a time, until ctx is cancelled. Tasks in progress are then released,
+// so another worker picks them up.
+func Work(ctx context.Context, client *Client, worker string, slots int, plan Planner) {
+	var wg sync.WaitGroup
+	for i := 0; i < slots; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				workOne(ctx, client, worker, plan)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// workOne leases a single task and plans it, heartbeating meanwhile. A
+// task whose lease is lost is abandoned, another worker plans it.
+func workOne(ctx context.Context, client *Client, worker string, plan Planner) {
+	task, err := client.Lease(ctx, worker)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		if !errors.Is(err, ErrUnavailable) {
+			log.Warnf("error leasing a task: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(retryInterval):
+		}
+		return
+	}
+	if task == nil {
+		return
+	}
+	log.Infof("planning %s of %s for task %s", strings.Join(task.Projects, ", "), task.Name, task.ID)
+
+	taskCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := make(chan struct{})
+	go heartbeat(taskCtx, client, task, worker, cancel, stop)
+
+	results, planErr := plan(taskCtx, *task)
+	close(stop)
+
+	// Updates are still sent while shutting down
+	updateCtx, cancelUpdate := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelUpdate()
+	switch {
+	case ctx.Err() != nil:
+		err = client.Release(updateCtx, task.ID, worker)
+	case taskCtx.Err() != nil:
+		log.Infof("abandoned task %s, its lease was lost", task.ID)
+		return
+	default:
+		err = client.Complete(updateCtx, task.ID, worker, results, planErr)
+	}
+	if err != nil {
+		log.Warnf("error reporting task %s: %s", task.ID, err)
+	}
+}
+
+// heartbeat keeps the lease of worker on task alive until stop is closed,
+// and calls cancel once the lease is lost.
+func heartbeat(ctx context.Context, client *Client, task *Task, worker string, cancel context.CancelFunc, stop chan struct{}) {
+	interval := time.Duration(task.LeaseSeconds) * time.Second / 3
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := client.Heartbeat(ctx, task.ID, worker)
+		switch {
+		case errors.Is(err, ErrLeaseLost):
+			log.Warnf("lost the lease on task %s, stopping it", task.ID)
+			cancel()
+			return
+		case err != nil && ctx.Err() == nil:
+			log.Warnf("error heartbeating task %s: %s", task.ID, err)
+		}
+	}
+}
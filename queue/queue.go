@@ -0,0 +1,280 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Run states. A run is queued until nothing it conflicts with is running,
+// and ends up succeeded, failed or cancelled.
+const (
+	StateQueued    = "queued"
+	StateRunning   = "running"
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"
+	StateCancelled = "cancelled"
+)
+
+// Triggers record what asked for a run.
+const (
+	TriggerCron    = "cron"
+	TriggerAPI     = "api"
+	TriggerWebhook = "webhook"
+)
+
+// history is how many finished runs are kept for lookups.
+const history = 100
+
+// ErrNotFound is returned for unknown run IDs.
+var ErrNotFound = errors.New("run not found")
+
+// ErrUnavailable is returned by resolvers of replicas that do not execute
+// runs, e.g. because another replica is the leader.
+var ErrUnavailable = errors.New("runs are executed by another replica")
+
+// Request asks for a drift run, of every repo or of a single repo or project.
+type Request struct {
+	// Repo is a repo url, name or group, every repo when empty.
+	Repo string `json:"repo,omitempty"`
+	// Project limits the run to a project, a path relative to Repo.
+	Project string `json:"project,omitempty"`
+	// Branch, when set, is the branch a push webhook reported and
+	// DefaultBranch the default branch of the pushed repo. The run is only
+	// requested when Repo scans that branch.
+	Branch        string `json:"-"`
+	DefaultBranch string `json:"-"`
+	Trigger       string `json:"trigger"`
+}
+
+// Run is a requested drift run and its outcome.
+type Run struct {
+	ID string `json:"id"`
+	Request
+	State    string     `json:"state"`
+	Error    string     `json:"error,omitempty"`
+	Queued   time.Time  `json:"queued_at"`
+	Started  *time.Time `json:"started_at,omitempty"`
+	Finished *time.Time `json:"finished_at,omitempty"`
+	// Projects maps the projects the run planned to their status.
+	Projects map[string]string `json:"projects,omitempty"`
+
+	// keys are what the run locks, runs sharing a key never run together.
+	keys   []string
+	cancel context.CancelFunc
+}
+
+// Resolver validates a request, rewriting its repo to a canonical name, and
+// returns the keys its run locks, e.g. the jobs of the repos it scans.
+type Resolver func(req *Request) ([]string, error)
+
+// Executor carries out a run and returns the status of each planned project.
+// It must stop early when ctx is cancelled.
+type Executor func(ctx context.Context, run *Run) (map[string]string, error)
+
+// Queue runs requested drift runs one after another, or in parallel when
+// they lock different keys. Requests identical to a queued run are
+// coalesced into it.
+type Queue struct {
+	mu       sync.Mutex
+	resolve  Resolver
+	execute  Executor
+	runs     map[string]*Run
+	order    []*Run
+	nextID   int
+	finished int
+}
+
+// New returns a queue resolving requests with resolve and carrying out runs
+// with execute.
+func New(resolve Resolver, execute Executor) *Queue {
+	return &Queue{resolve: resolve, execute: execute, runs: make(map[string]*Run)}
+}
+
+// Submit queues req and returns its run. When an identical request is
+// already queued, that run is returned instead and coalesced is true.
+func (q *Queue) Submit(req Request) (run Run, coalesced bool, err error) {
+	keys, err := q.resolve(&req)
+	if err != nil {
+		return Run{}, false, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, r := range q.order {
+		if r.State == StateQueued && r.Repo == req.Repo && r.Project == req.Project {
+			log.Infof("coalescing %s request into run %s", req.Trigger, r.ID)
+			return *r, true, nil
+		}
+	}
+
+	q.nextID++
+	r := &Run{
+		ID:      fmt.Sprintf("%d-%d", time.Now().Unix(), q.nextID),
+		Request: req,
+		State:   StateQueued,
+		Queued:  time.Now(),
+		keys:    keys,
+	}
+	q.runs[r.ID] = r
+	q.order = append(q.order, r)
+	log.Infof("queued run %s of %s by %s", r.ID, describe(req), req.Trigger)
+
+	q.dispatch()
+	return *r, false, nil
+}
+
+// Get returns a snapshot of the run with id.
+func (q *Queue) Get(id string) (Run, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	r, ok := q.runs[id]
+	if !ok {
+		return Run{}, ErrNotFound
+	}
+	return *r, nil
+}
+
+// List returns snapshots of all known runs, oldest first.
+func (q *Queue) List() []Run {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	runs := make([]Run, 0, len(q.order))
+	for _, r := range q.order {
+		runs = append(runs, *r)
+	}
+	return runs
+}
+
+// Cancel cancels the run with id. Queued runs are cancelled right away,
+// running ones once their plans have been interrupted.
+func (q *Queue) Cancel(id string) (Run, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	r, ok := q.runs[id]
+	if !ok {
+		return Run{}, ErrNotFound
+	}
+	switch r.State {
+	case StateQueued:
+		q.finish(r, StateCancelled, "")
+		q.dispatch()
+	case StateRunning:
+		log.Infof("cancelling run %s", r.ID)
+		r.cancel()
+	default:
+		return *r, fmt.Errorf("run %s is already %s", r.ID, r.State)
+	}
+	return *r, nil
+}
+
+// CancelAll cancels every queued and running run.
+func (q *Queue) CancelAll() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, r := range q.order {
+		switch r.State {
+		case StateQueued:
+			q.finish(r, StateCancelled, "")
+		case StateRunning:
+			r.cancel()
+		}
+	}
+}
+
+// dispatch starts every queued run that conflicts neither with a running
+// run nor with an earlier queued one. The caller holds q.mu.
+func (q *Queue) dispatch() {
+	busy := make(map[string]bool)
+	for _, r := range q.order {
+		switch r.State {
+		case StateRunning:
+			for _, key := range r.keys {
+				busy[key] = true
+			}
+		case StateQueued:
+			free := true
+			for _, key := range r.keys {
+				if busy[key] {
+					free = false
+				}
+				busy[key] = true
+			}
+			if free {
+				q.start(r)
+			}
+		}
+	}
+}
+
+// start runs r in the background. The caller holds q.mu.
+func (q *Queue) start(r *Run) {
+	ctx, cancel := context.WithCancel(context.Background())
+	now := time.Now()
+	r.State = StateRunning
+	r.Started = &now
+	r.cancel = cancel
+	log.Infof("starting run %s of %s", r.ID, describe(r.Request))
+
+	snapshot := *r
+	go func() {
+		projects, err := q.execute(ctx, &snapshot)
+		cancelled := ctx.Err() != nil
+		cancel()
+
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		r.Projects = projects
+		switch {
+		case cancelled && err != nil:
+			q.finish(r, StateCancelled, "")
+		case err != nil:
+			q.finish(r, StateFailed, err.Error())
+		default:
+			q.finish(r, StateSucceeded, "")
+		}
+		q.dispatch()
+	}()
+}
+
+// finish records the end of r and forgets the oldest finished runs beyond
+// history. The caller holds q.mu.
+func (q *Queue) finish(r *Run, state, message string) {
+	now := time.Now()
+	r.State = state
+	r.Error = message
+	r.Finished = &now
+	log.Infof("run %s %s", r.ID, state)
+
+	q.finished++
+	for q.finished > history {
+		for i, old := range q.order {
+			if old.Finished != nil {
+				delete(q.runs, old.ID)
+				q.order = append(q.order[:i], q.order[i+1:]...)
+				q.finished--
+				break
+			}
+		}
+	}
+}
+
+func describe(req Request) string {
+	switch {
+	case req.Repo == "":
+		return "all repos"
+	case req.Project != "":
+		return req.Repo + "/" + req.Project
+	default:
+		return req.Repo
+	}
+}
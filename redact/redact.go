@@ -0,0 +1,211 @@
+package redact
+
+import (
+	"atlantis-drift-detector/plan"
+	"atlantis-drift-detector/report"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Placeholder replaces every redacted value.
+const Placeholder = "(sensitive)"
+
+// defaultPatterns match common credentials. The whole match is redacted,
+// except for a leading key= or key: captured by the first group, and a
+// trailing delimiter captured by the second, which are kept for context.
+var defaultPatterns = []string{
+	`AKIA[0-9A-Z]{16}`,                                              // AWS access key ids
+	`gh[pousr]_[A-Za-z0-9]{36,}`,                                    // GitHub tokens
+	`glpat-[A-Za-z0-9_-]{20,}`,                                      // GitLab tokens
+	`xox[abposr]-[A-Za-z0-9-]{10,}`,                                 // Slack tokens
+	`eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`, // JWTs
+	`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?-----END [A-Z ]*PRIVATE KEY-----`,
+	`(?i)(://[^:/@\s]+:)[^@/\s]+(@)`, // credentials in URLs
+	`(?i)((?:password|passwd|secret|token|api_?key|access_?key)["']?\s*[=:]\s*)["']?[^\s"',]+["']?`,
+}
+
+// patterns are replaced on config reloads while values are redacted.
+var patterns = struct {
+	sync.RWMutex
+	current Patterns
+}{current: mustCompile(defaultPatterns)}
+
+func mustCompile(expressions []string) []*regexp.Regexp {
+	compiled, err := compile(expressions)
+	if err != nil {
+		panic(err)
+	}
+	return compiled
+}
+
+func compile(expressions []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, expression := range expressions {
+		re, err := regexp.Compile(expression)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %w", expression, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// Patterns are the compiled expressions secrets are matched with.
+type Patterns []*regexp.Regexp
+
+// LoadPatterns returns the built-in patterns plus the regular expressions in
+// file, one per line. Blank lines and lines starting with # are skipped.
+func LoadPatterns(file string) (Patterns, error) {
+	if file == "" {
+		return mustCompile(defaultPatterns), nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var expressions []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		expressions = append(expressions, line)
+	}
+
+	extra, err := compile(expressions)
+	if err != nil {
+		return nil, err
+	}
+	return append(mustCompile(defaultPatterns), extra...), nil
+}
+
+// UsePatterns replaces the patterns everything is redacted with.
+func UsePatterns(p Patterns) {
+	patterns.Lock()
+	defer patterns.Unlock()
+	patterns.current = p
+}
+
+// String redacts everything in s that matches a pattern.
+func String(s string) string {
+	patterns.RLock()
+	current := patterns.current
+	patterns.RUnlock()
+
+	for _, re := range current {
+		s = re.ReplaceAllStringFunc(s, func(match string) string {
+			// Keep a captured key= prefix and @ suffix so the output stays
+			// readable
+			groups := re.FindStringSubmatch(match)
+			redacted := Placeholder
+			if len(groups) > 1 && groups[1] != "" && strings.HasPrefix(match, groups[1]) {
+				redacted = groups[1] + redacted
+			}
+			if len(groups) > 2 && groups[2] != "" && strings.HasSuffix(match, groups[2]) {
+				redacted += groups[2]
+			}
+			return redacted
+		})
+	}
+	return s
+}
+
+// Report redacts every free-form value of repoReport in place. It must be
+// applied before a report is persisted, served or sent anywhere.
+func Report(repoReport *report.Report) {
+	for i := range repoReport.Results {
+		result := &repoReport.Results[i]
+		result.Output = String(result.Output)
+		for _, changes := range [][]report.Change{result.Changes, result.Drift, result.Suppressed} {
+			for j := range changes {
+				for k := range changes[j].Diff {
+					changes[j].Diff[k].Before = String(changes[j].Diff[k].Before)
+					changes[j].Diff[k].After = String(changes[j].Diff[k].After)
+				}
+			}
+		}
+	}
+}
+
+// Diff returns the before and after values of the given attributes of rc.
+// Values Terraform marks as sensitive, in before_sensitive, after_sensitive
+// or the sensitive_values of planned_values, are replaced with Placeholder,
+// everything else goes through String.
+func Diff(p *plan.Plan, rc *plan.ResourceChange, attributes []string) []report.AttributeDiff {
+	planned := p.SensitiveValues(rc.Address)
+	diffs := make([]report.AttributeDiff, 0, len(attributes))
+	for _, attribute := range attributes {
+		diffs = append(diffs, report.AttributeDiff{
+			Path:   attribute,
+			Before: value(rc.Change.Before, nil, attribute, rc.Change.BeforeSensitive),
+			After:  value(rc.Change.After, rc.Change.AfterUnknown, attribute, rc.Change.AfterSensitive, planned),
+		})
+	}
+	return diffs
+}
+
+func value(values, unknown interface{}, attribute string, sensitive ...interface{}) string {
+	parts := strings.Split(attribute, ".")
+	for _, markers := range sensitive {
+		if marked(markers, parts) {
+			return Placeholder
+		}
+	}
+	if marked(unknown, parts) {
+		return "(known after apply)"
+	}
+
+	v, found := lookup(values, parts)
+	if !found || v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return String(s)
+	}
+	data, _ := json.Marshal(v)
+	return String(string(data))
+}
+
+// marked reports whether a sensitive or unknown marker structure flags the
+// attribute at parts, or any attribute containing it, as true.
+func marked(markers interface{}, parts []string) bool {
+	if flag, ok := markers.(bool); ok {
+		return flag
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	next, found := lookup(markers, parts[:1])
+	if !found {
+		return false
+	}
+	return marked(next, parts[1:])
+}
+
+func lookup(v interface{}, parts []string) (interface{}, bool) {
+	for _, part := range parts {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			child, ok := node[part]
+			if !ok {
+				return nil, false
+			}
+			v = child
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
@@ -0,0 +1,63 @@
+package report
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Formats reports can be printed in, see Write.
+var Formats = []string{"json", "csv", "md"}
+
+// Write prints reports to w in format: json with every detail, csv with the
+// columns of the stored CSV reports, or md with a table per repo.
+func Write(w io.Writer, format string, reports []*Report) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(reports)
+	case "csv":
+		writer := csv.NewWriter(w)
+		for _, repoReport := range reports {
+			for _, result := range repoReport.Results {
+				err := writer.Write([]string{result.Project, result.Status, result.Commit, result.BlockedBy, result.Severity})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	case "md":
+		return writeMarkdown(w, reports)
+	default:
+		return fmt.Errorf("unknown format %q, expected one of %s", format, strings.Join(Formats, ", "))
+	}
+}
+
+func writeMarkdown(w io.Writer, reports []*Report) error {
+	for i, repoReport := range reports {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "## %s", repoReport.Repo)
+		if commit := repoReport.ShortCommit(); commit != "" {
+			fmt.Fprintf(w, " at `%s`", commit)
+		}
+		fmt.Fprintf(w, "\n\n| Project | Status | Severity | Blocked by |\n| --- | --- | --- | --- |\n")
+		for _, result := range repoReport.Results {
+			status := result.Status
+			if result.Flaky {
+				status += " (flaky)"
+			}
+			_, err := fmt.Fprintf(w, "| %s | %s | %s | %s |\n", result.Project, status, result.Severity, result.BlockedBy)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package report
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Dir is where reports are stored, one CSV and one JSON file per repository,
+// see UseDir.
+var Dir = "csv/data"
+
+// UseDir stores and reads reports in dir.
+func UseDir(dir string) {
+	Dir = dir
+}
+
+// CSVPath returns the path of the CSV report of repo.
+func CSVPath(repo string) string {
+	return filepath.Join(Dir, repo+"_report.csv")
+}
+
+// JSONPath returns the path of the detailed JSON report of repo.
+func JSONPath(repo string) string {
+	return filepath.Join(Dir, repo+"_report.json")
+}
+
+// Project statuses as they are stored in the CSV reports.
+const (
+	StatusDrifted   = "drifted"
+	StatusError     = "error"
+	StatusNoChanges = "No changes"
+	// StatusBlocked marks projects that were not planned because an upstream
+	// dependency failed.
+	StatusBlocked = "blocked"
+
+	// In refresh-only mode drift is split by its origin: infrastructure
+	// changed outside Terraform, code merged but never applied, or both.
+	StatusOutOfBand          = "out-of-band drift"
+	StatusUnapplied          = "unapplied code"
+	StatusOutOfBandUnapplied = "out-of-band drift and unapplied code"
+)
+
+// IsDrift reports whether status is one of the drifted statuses.
+func IsDrift(status string) bool {
+	switch status {
+	case StatusDrifted, StatusOutOfBand, StatusUnapplied, StatusOutOfBandUnapplied:
+		return true
+	}
+	return false
+}
+
+// Result is the outcome of planning a single project.
+type Result struct {
+	Project string
+	Status  string
+	// Commit is the sha of the revision the project was planned at.
+	Commit string
+	// BlockedBy is the upstream project whose failure blocked this one.
+	BlockedBy string
+	// Severity rates drifted projects as low, medium, high or critical.
+	Severity string `json:",omitempty"`
+	// Changes are the resource changes that made the project drift.
+	Changes []Change `json:",omitempty"`
+	// Drift are the resources changed outside Terraform, as found by a
+	// refresh-only plan.
+	Drift []Change `json:",omitempty"`
+	// Suppressed are resource changes filtered out by ignore rules.
+	Suppressed []Change `json:",omitempty"`
+	// TerraformVersion and TerragruntVersion are the versions the project
+	// was planned with, empty when unknown.
+	TerraformVersion  string `json:",omitempty"`
+	TerragruntVersion string `json:",omitempty"`
+	// Output is the tail of the plan output of errored projects.
+	Output string `json:",omitempty"`
+	// Attempts lists every plan of a project that was retried after a
+	// transient error.
+	Attempts []Attempt `json:",omitempty"`
+	// Flaky marks projects that only planned successfully on a retry.
+	Flaky bool `json:",omitempty"`
+}
+
+// Attempt is a single plan of a retried project.
+type Attempt struct {
+	// Error is the last line of output of a failed attempt, empty when the
+	// attempt succeeded.
+	Error string `json:",omitempty"`
+	// Category is the retryable category of the error, e.g. registry,
+	// empty when it is not retryable.
+	Category string `json:",omitempty"`
+}
+
+// Change describes a planned change to a single resource.
+type Change struct {
+	Address string
+	Type    string
+	Actions []string
+	// Attributes are the dotted paths of the changed attributes.
+	Attributes []string `json:",omitempty"`
+	// Diff holds the before and after values of the changed attributes.
+	Diff []AttributeDiff `json:",omitempty"`
+	// Rule explains why a suppressed change was ignored.
+	Rule string `json:",omitempty"`
+}
+
+// AttributeDiff is the redacted before and after value of one attribute.
+type AttributeDiff struct {
+	Path   string
+	Before string
+	After  string
+}
+
+// Report holds the results of scanning one repository at one revision.
+type Report struct {
+	Repo    string
+	Commit  string
+	Results []Result
+}
+
+// Drifted returns the projects that ended up with any of the drifted statuses.
+func (r *Report) Drifted() []string {
+	var projects []string
+	for _, result := range r.Results {
+		if IsDrift(result.Status) {
+			projects = append(projects, result.Project)
+		}
+	}
+	return projects
+}
+
+// Projects returns the projects that ended up with status.
+func (r *Report) Projects(status string) []string {
+	var projects []string
+	for _, result := range r.Results {
+		if result.Status == status {
+			projects = append(projects, result.Project)
+		}
+	}
+	return projects
+}
+
+// ShortCommit returns the abbreviated sha of the scanned revision.
+func (r *Report) ShortCommit() string {
+	if len(r.Commit) > 7 {
+		return r.Commit[:7]
+	}
+	return r.Commit
+}
+
+// ReadCSV loads a report previously written by the notifier. Only the
+// results are restored, the report level fields are left empty.
+func ReadCSV(filename string) (*Report, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	repoReport := &Report{}
+	for _, record := range records {
+		if len(record) < 2 {
+			continue
+		}
+		result := Result{Project: record[0], Status: record[1]}
+		if len(record) > 2 {
+			result.Commit = record[2]
+		}
+		if len(record) > 3 {
+			result.BlockedBy = record[3]
+		}
+		if len(record) > 4 {
+			result.Severity = record[4]
+		}
+		repoReport.Results = append(repoReport.Results, result)
+	}
+	return repoReport, nil
+}
+
+// WriteJSON stores the full report, including resource level details, in
+// filename.
+func WriteJSON(filename string, repoReport *Report) error {
+	data, err := json.MarshalIndent(repoReport, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0644)
+}
+
+// ReadJSON loads a report stored by WriteJSON.
+func ReadJSON(filename string) (*Report, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	repoReport := &Report{}
+	err = json.Unmarshal(data, repoReport)
+	if err != nil {
+		return nil, err
+	}
+	return repoReport, nil
+}
+
+// Load returns the latest stored report of repo, preferring the detailed JSON
+// report and falling back to the CSV one.
+func Load(repo string) (*Report, error) {
+	repoReport, err := ReadJSON(JSONPath(repo))
+	if err == nil {
+		return repoReport, nil
+	}
+	repoReport, err = ReadCSV(CSVPath(repo))
+	if err != nil {
+		return nil, err
+	}
+	repoReport.Repo = repo
+	return repoReport, nil
+}
+
+// Repos returns the repos with a stored report, sorted by name.
+func Repos() ([]string, error) {
+	entries, err := os.ReadDir(Dir)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var repos []string
+	for _, entry := range entries {
+		name := entry.Name()
+		repo := strings.TrimSuffix(strings.TrimSuffix(name, "_report.csv"), "_report.json")
+		if repo == name || seen[repo] {
+			continue
+		}
+		seen[repo] = true
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	return repos, nil
+}
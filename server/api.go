@@ -0,0 +1,230 @@
+package server
+
+import (
+	"atlantis-drift-detector/queue"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runs is the queue the API submits runs to, see UseQueue.
+var runs *queue.Queue
+
+// apiToken and webhookSecret protect the API, see UseAPIAuth.
+var apiToken, webhookSecret string
+
+// UseQueue serves the runs API from q.
+func UseQueue(q *queue.Queue) {
+	runs = q
+}
+
+// UseAPIAuth requires token as a bearer token on the runs API, when set,
+// and verifies GitHub webhooks with secret. Webhooks are refused without a
+// secret.
+func UseAPIAuth(token, secret string) {
+	apiToken = token
+	webhookSecret = secret
+}
+
+func setupAPIRoutes() {
+	http.HandleFunc("/drift-detector/api/runs", runsHandler)
+	http.HandleFunc("/drift-detector/api/runs/", runHandler)
+	http.HandleFunc("/drift-detector/api/webhooks/github", gitHubWebhookHandler)
+	http.HandleFunc("/drift-detector/api/tasks", tasksHandler)
+	http.HandleFunc("/drift-detector/api/tasks/", taskHandler)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Warnf("error writing response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// authorized checks the bearer token of r, answering with 401 when it is
+// missing or wrong.
+func authorized(w http.ResponseWriter, r *http.Request) bool {
+	if apiToken == "" {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) != 1 {
+		writeError(w, http.StatusUnauthorized, errors.New("invalid or missing api token"))
+		return false
+	}
+	return true
+}
+
+// runsHandler lists runs on GET and queues a run on POST. The request body
+// or query may scope the run with repo and project.
+func runsHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	if runs == nil {
+		writeError(w, http.StatusServiceUnavailable, errors.New("runs are not available"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, runs.List())
+	case http.MethodPost:
+		req := queue.Request{Repo: r.URL.Query().Get("repo"), Project: r.URL.Query().Get("project")}
+		if r.ContentLength != 0 {
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil && err != io.EOF {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		req.Trigger = queue.TriggerAPI
+
+		run, coalesced, err := runs.Submit(req)
+		switch {
+		case errors.Is(err, queue.ErrUnavailable):
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		case err != nil:
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		status := http.StatusAccepted
+		if coalesced {
+			status = http.StatusOK
+		}
+		writeJSON(w, status, run)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// runHandler returns a run on GET and cancels it on DELETE.
+func runHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	if runs == nil {
+		writeError(w, http.StatusServiceUnavailable, errors.New("runs are not available"))
+		return
+	}
+
+	id, err := url.PathUnescape(strings.TrimPrefix(r.URL.Path, "/drift-detector/api/runs/"))
+	if err != nil || id == "" || strings.Contains(id, "/") {
+		writeError(w, http.StatusNotFound, queue.ErrNotFound)
+		return
+	}
+
+	var run queue.Run
+	switch r.Method {
+	case http.MethodGet:
+		run, err = runs.Get(id)
+	case http.MethodDelete:
+		run, err = runs.Cancel(id)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	switch {
+	case errors.Is(err, queue.ErrNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case err != nil:
+		writeError(w, http.StatusConflict, err)
+	default:
+		writeJSON(w, http.StatusOK, run)
+	}
+}
+
+// pushEvent holds the fields of a GitHub push event the detector uses.
+type pushEvent struct {
+	Ref        string `json:"ref"`
+	Repository struct {
+		FullName      string `json:"full_name"`
+		HTMLURL       string `json:"html_url"`
+		DefaultBranch string `json:"default_branch"`
+	} `json:"repository"`
+}
+
+// gitHubWebhookHandler queues a run of the pushed repo when the push went to
+// the branch the detector scans.
+func gitHubWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	if runs == nil || webhookSecret == "" {
+		writeError(w, http.StatusServiceUnavailable, errors.New("webhooks are not configured"))
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 10<<20))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	mac := hmac.New(sha256.New, []byte(webhookSecret))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(r.Header.Get("X-Hub-Signature-256")), []byte(expected)) {
+		writeError(w, http.StatusUnauthorized, errors.New("invalid signature"))
+		return
+	}
+
+	switch r.Header.Get("X-GitHub-Event") {
+	case "ping":
+		writeJSON(w, http.StatusOK, map[string]string{"status": "pong"})
+		return
+	case "push":
+	default:
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ignored"})
+		return
+	}
+
+	var event pushEvent
+	err = json.Unmarshal(body, &event)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	repoURL, err := url.Parse(event.Repository.HTMLURL)
+	if err != nil || event.Repository.FullName == "" || !strings.HasPrefix(event.Ref, "refs/heads/") {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ignored"})
+		return
+	}
+
+	run, _, err := runs.Submit(queue.Request{
+		Repo:          repoURL.Host + "/" + event.Repository.FullName,
+		Branch:        strings.TrimPrefix(event.Ref, "refs/heads/"),
+		DefaultBranch: event.Repository.DefaultBranch,
+		Trigger:       queue.TriggerWebhook,
+	})
+	if errors.Is(err, queue.ErrUnavailable) {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err != nil {
+		// Pushes to repos or branches that are not scanned are expected
+		log.Debugf("ignoring push webhook: %s", err)
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ignored", "reason": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, run)
+}
@@ -2,12 +2,19 @@ package server
 
 import (
 	"archive/zip"
+	"atlantis-drift-detector/redact"
+	"atlantis-drift-detector/report"
+	"atlantis-drift-detector/severity"
 	"encoding/csv"
 	"fmt"
+	"html"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -15,22 +22,29 @@ import (
 )
 
 type Node struct {
-	Name     string
-	Status   string
+	Name      string
+	Status    string
+	Commit    string
+	BlockedBy string
+	Severity  string
+	// Project is the full project path of leaf nodes, used to link details.
+	Project  string
 	Children map[string]*Node
 }
 
 func setupRoutes() {
 	http.HandleFunc("/drift-detector/report", reportHandler)
+	http.HandleFunc("/drift-detector/details", detailsHandler)
 	http.HandleFunc("/drift-detector/download-reports", downloadReportsHandler)
 	http.Handle("/drift-detector/metrics", promhttp.Handler())
 	http.Handle("/drift-detector/static/", http.StripPrefix("/drift-detector/static/", http.FileServer(http.Dir("./static"))))
+	setupAPIRoutes()
 }
 
-func Run() {
+func Run(port int) {
 	setupRoutes()
-	log.Info("server is running on port 8080")
-	http.ListenAndServe(":8080", nil)
+	log.Infof("server is running on port %d", port)
+	http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
 }
 
 const closedFolderIcon = `<i class='fas fa-folder'></i>`
@@ -48,12 +62,18 @@ func renderNode(node *Node, depth int) string {
 	case "error":
 		statusColor = "color:red;"
 		folderColor = "background-color:#ffd5d5;" // light red
-	case "drifted":
+	case "drifted", "unapplied code":
 		statusColor = "color:black;"              // Using black text for yellow background for better readability
 		folderColor = "background-color:#fff3cd;" // light yellow
 	case "No changes":
 		statusColor = "color:green;"
 		folderColor = "background-color:#d4edda;" // light green
+	case "out-of-band drift", "out-of-band drift and unapplied code":
+		statusColor = "color:black;"
+		folderColor = "background-color:#ffe5b4;" // light orange
+	case "blocked":
+		statusColor = "color:#6c757d;"
+		folderColor = "background-color:#e9ecef;" // light grey
 	default:
 		folderColor = "background-color:white;"
 	}
@@ -66,16 +86,33 @@ func renderNode(node *Node, depth int) string {
 		displayProperty = "block"
 	}
 
+	status := node.Status
+	if node.BlockedBy != "" {
+		status += " by " + node.BlockedBy
+	}
+	if node.Severity != "" {
+		status += fmt.Sprintf(` <span class="severity severity-%s">%s</span>`, node.Severity, node.Severity)
+	}
+
+	name := node.Name
+	if node.Commit != "" {
+		name += fmt.Sprintf(` <span class="commit" title="%s">@ %s</span>`, node.Commit, shortCommit(node.Commit))
+	}
+
+	if node.Project != "" && (report.IsDrift(node.Status) || node.Status == "No changes" || node.Status == "error") {
+		status += fmt.Sprintf(` <a href="/drift-detector/details?project=%s" onclick="event.stopPropagation()">details</a>`, url.QueryEscape(node.Project))
+	}
+
 	var result string
 	if depth > 0 || (depth == 0 && node.Status != "") {
-		result = fmt.Sprintf(`<div style="%s;cursor:pointer;%s" onclick="toggleChildren(event)">%s %s <span style="%s"> %s</span></div>`, indentation, folderColor, closedFolderIcon, node.Name, statusColor, node.Status)
+		result = fmt.Sprintf(`<div style="%s;cursor:pointer;%s" onclick="toggleChildren(event)">%s %s <span style="%s"> %s</span></div>`, indentation, folderColor, closedFolderIcon, name, statusColor, status)
 	} else {
-		result = fmt.Sprintf(`<div style="%s;cursor:pointer;%s" onclick="toggleChildren(event)">%s %s</div>`, indentation, folderColor, closedFolderIcon, node.Name)
+		result = fmt.Sprintf(`<div style="%s;cursor:pointer;%s" onclick="toggleChildren(event)">%s %s</div>`, indentation, folderColor, closedFolderIcon, name)
 	}
 
 	if len(node.Children) > 0 {
 		result += fmt.Sprintf(`<div style="display:%s;">`, displayProperty)
-		for _, child := range node.Children {
+		for _, child := range sortedChildren(node) {
 			result += renderNode(child, depth+1)
 		}
 		result += `</div>`
@@ -84,8 +121,40 @@ func renderNode(node *Node, depth int) string {
 	return result
 }
 
+// sortedChildren orders the children of node by the most severe drift below
+// them, then by name.
+func sortedChildren(node *Node) []*Node {
+	children := make([]*Node, 0, len(node.Children))
+	for _, child := range node.Children {
+		children = append(children, child)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		a, b := severity.Rank(maxSeverity(children[i])), severity.Rank(maxSeverity(children[j]))
+		if a != b {
+			return a > b
+		}
+		return children[i].Name < children[j].Name
+	})
+	return children
+}
+
+func maxSeverity(node *Node) string {
+	highest := node.Severity
+	for _, child := range node.Children {
+		highest = severity.Max(highest, maxSeverity(child))
+	}
+	return highest
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 7 {
+		return commit[:7]
+	}
+	return commit
+}
+
 func reportHandler(w http.ResponseWriter, r *http.Request) {
-	files, err := ioutil.ReadDir("csv/data/")
+	files, err := ioutil.ReadDir(report.Dir)
 	if err != nil {
 		http.Error(w, "Failed to list CSV files", http.StatusInternalServerError)
 		return
@@ -96,11 +165,11 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
 		Name:     "chainstack",
 		Children: make(map[string]*Node),
 	}
-	var totalErrorCount, totalDriftedCount, totalNoChangesCount int
+	var totalErrorCount, totalDriftedCount, totalNoChangesCount, totalBlockedCount int
 
 	for _, file := range files {
 		if strings.HasSuffix(file.Name(), ".csv") {
-			root, errorCount, driftedCount, noChangesCount, err := ReadCSVToNodes("csv/data/" + file.Name())
+			root, errorCount, driftedCount, noChangesCount, blockedCount, err := ReadCSVToNodes(filepath.Join(report.Dir, file.Name()))
 			if err != nil {
 				continue
 			}
@@ -109,6 +178,7 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
 			totalErrorCount += errorCount
 			totalDriftedCount += driftedCount
 			totalNoChangesCount += noChangesCount
+			totalBlockedCount += blockedCount
 		}
 	}
 
@@ -117,8 +187,9 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
             let errorCount = %d;
             let driftedCount = %d;
             let noChangesCount = %d;
+            let blockedCount = %d;
         </script>
-    `, totalErrorCount, totalDriftedCount, totalNoChangesCount)
+    `, totalErrorCount, totalDriftedCount, totalNoChangesCount, totalBlockedCount)
 
 	allData := renderNode(unifiedRoot, 0)
 
@@ -135,6 +206,112 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(htmlStr))
 }
 
+// detailsHandler renders the resource changes of a single project, including
+// the ones suppressed by ignore rules.
+func detailsHandler(w http.ResponseWriter, r *http.Request) {
+	project := r.URL.Query().Get("project")
+	repo := strings.Split(project, "/")[0]
+	if repo == "" || strings.Contains(repo, "..") {
+		http.Error(w, "Missing project", http.StatusBadRequest)
+		return
+	}
+
+	repoReport, err := report.ReadJSON(report.JSONPath(repo))
+	if err != nil {
+		http.Error(w, "No detailed report for "+repo, http.StatusNotFound)
+		return
+	}
+
+	var result *report.Result
+	for i := range repoReport.Results {
+		if repoReport.Results[i].Project == project {
+			result = &repoReport.Results[i]
+		}
+	}
+	if result == nil {
+		http.Error(w, "Unknown project", http.StatusNotFound)
+		return
+	}
+
+	body := fmt.Sprintf(`<h2>%s</h2><p>%s at <span class="commit">%s</span></p>`, html.EscapeString(result.Project), html.EscapeString(result.Status), html.EscapeString(result.Commit))
+	if result.Severity != "" {
+		body += fmt.Sprintf(`<p>Severity: <span class="severity severity-%s">%s</span></p>`, html.EscapeString(result.Severity), html.EscapeString(result.Severity))
+	}
+	if result.TerraformVersion != "" || result.TerragruntVersion != "" {
+		var planned []string
+		if result.TerraformVersion != "" {
+			planned = append(planned, "Terraform "+result.TerraformVersion)
+		}
+		if result.TerragruntVersion != "" {
+			planned = append(planned, "Terragrunt "+result.TerragruntVersion)
+		}
+		body += fmt.Sprintf(`<p>Planned with %s</p>`, html.EscapeString(strings.Join(planned, ", ")))
+	}
+	if result.Flaky {
+		body += fmt.Sprintf(`<p>Flaky: planned successfully on attempt %d</p>`, len(result.Attempts))
+	}
+	// Reports are redacted when stored, this guards against older reports
+	redact.Report(repoReport)
+
+	body += renderChanges("Changes", result.Changes, false)
+	body += renderChanges("Out-of-band drift", result.Drift, false)
+	body += renderChanges("Suppressed", result.Suppressed, true)
+	if result.Output != "" {
+		body += fmt.Sprintf(`<h3>Output</h3><pre>%s</pre>`, html.EscapeString(result.Output))
+	}
+	body += renderAttempts(result.Attempts)
+
+	w.Write([]byte(`<!DOCTYPE html><html lang="en"><head><meta charset="UTF-8"><title>Drift detector</title>` +
+		`<link rel="stylesheet" type="text/css" href="/drift-detector/static/style.css"></head>` +
+		`<body><div class="container details">` + body + `</div></body></html>`))
+}
+
+func renderAttempts(attempts []report.Attempt) string {
+	if len(attempts) == 0 {
+		return ""
+	}
+
+	result := `<h3>Attempts</h3><table><tr><th>Attempt</th><th>Category</th><th>Error</th></tr>`
+	for i, attempt := range attempts {
+		outcome := attempt.Error
+		if outcome == "" {
+			outcome = "succeeded"
+		}
+		result += fmt.Sprintf(`<tr><td>%d</td><td>%s</td><td>%s</td></tr>`, i+1, html.EscapeString(attempt.Category), html.EscapeString(outcome))
+	}
+	return result + `</table>`
+}
+
+func renderChanges(title string, changes []report.Change, suppressed bool) string {
+	if len(changes) == 0 {
+		return ""
+	}
+
+	result := fmt.Sprintf(`<h3>%s</h3><table><tr><th>Resource</th><th>Actions</th><th>Changed attributes</th>`, title)
+	if suppressed {
+		result += `<th>Rule</th>`
+	}
+	result += `</tr>`
+	for _, change := range changes {
+		attributes := html.EscapeString(strings.Join(change.Attributes, ", "))
+		if len(change.Diff) > 0 {
+			attributes = ""
+			for _, diff := range change.Diff {
+				attributes += fmt.Sprintf(`<div><b>%s</b>: %s &rarr; %s</div>`, html.EscapeString(diff.Path), html.EscapeString(diff.Before), html.EscapeString(diff.After))
+			}
+		}
+		result += fmt.Sprintf(`<tr><td>%s</td><td>%s</td><td>%s</td>`,
+			html.EscapeString(change.Address),
+			html.EscapeString(strings.Join(change.Actions, ", ")),
+			attributes)
+		if suppressed {
+			result += fmt.Sprintf(`<td>%s</td>`, html.EscapeString(change.Rule))
+		}
+		result += `</tr>`
+	}
+	return result + `</table>`
+}
+
 // mergeTrees will merge src into dest recursively
 func mergeTrees(dest, src *Node) {
 	for name, srcChild := range src.Children {
@@ -146,21 +323,23 @@ func mergeTrees(dest, src *Node) {
 	}
 }
 
-func ReadCSVToNodes(filepath string) (*Node, int, int, int, error) {
+func ReadCSVToNodes(filepath string) (*Node, int, int, int, int, error) {
 	errorCount := 0
 	driftedCount := 0
 	noChangesCount := 0
+	blockedCount := 0
 
 	file, err := os.Open(filepath)
 	if err != nil {
-		return nil, errorCount, driftedCount, noChangesCount, err
+		return nil, errorCount, driftedCount, noChangesCount, blockedCount, err
 	}
 	defer file.Close()
 
 	r := csv.NewReader(file)
+	r.FieldsPerRecord = -1
 	records, err := r.ReadAll()
 	if err != nil {
-		return nil, errorCount, driftedCount, noChangesCount, err
+		return nil, errorCount, driftedCount, noChangesCount, blockedCount, err
 	}
 
 	root := &Node{Children: make(map[string]*Node)}
@@ -171,10 +350,12 @@ func ReadCSVToNodes(filepath string) (*Node, int, int, int, error) {
 		status := record[1]
 		if status == "error" {
 			errorCount++
-		} else if status == "drifted" {
+		} else if report.IsDrift(status) {
 			driftedCount++
 		} else if status == "No changes" {
 			noChangesCount++
+		} else if status == "blocked" {
+			blockedCount++
 		}
 		for i, path := range paths {
 			if current.Children[path] == nil {
@@ -184,18 +365,28 @@ func ReadCSVToNodes(filepath string) (*Node, int, int, int, error) {
 				}
 			}
 			current = current.Children[path]
+			// The repo folder shows the revision its projects were planned at
+			if i == 0 && len(record) > 2 {
+				current.Commit = record[2]
+			}
 			if i == len(paths)-1 && path != "prod" && path != "dev" {
 				current.Status = status
+				current.Project = record[0]
+				if len(record) > 3 {
+					current.BlockedBy = record[3]
+				}
+				if len(record) > 4 {
+					current.Severity = record[4]
+				}
 			}
 		}
 	}
 
-	return root, errorCount, driftedCount, noChangesCount, nil
+	return root, errorCount, driftedCount, noChangesCount, blockedCount, nil
 }
 
 func downloadReportsHandler(w http.ResponseWriter, r *http.Request) {
-	folderPath := "/csv/data/"
-	files, err := ioutil.ReadDir(folderPath)
+	files, err := ioutil.ReadDir(report.Dir)
 	if err != nil {
 		http.Error(w, "Failed to read the directory", http.StatusInternalServerError)
 		return
@@ -204,7 +395,7 @@ func downloadReportsHandler(w http.ResponseWriter, r *http.Request) {
 	var filePaths []string
 	for _, file := range files {
 		if strings.HasSuffix(file.Name(), ".csv") {
-			filePaths = append(filePaths, folderPath+file.Name())
+			filePaths = append(filePaths, filepath.Join(report.Dir, file.Name()))
 		}
 	}
 
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"atlantis-drift-detector/pool"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// workPool hands out tasks to workers, see UsePool.
+var workPool *pool.Pool
+
+// UsePool serves the tasks API, which workers lease tasks from, from p.
+func UsePool(p *pool.Pool) {
+	workPool = p
+}
+
+// leaseWait is how long a lease request waits for a task to be queued.
+const leaseWait = 20 * time.Second
+
+// tasksHandler lists the queued and leased tasks on GET.
+func tasksHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	if workPool == nil {
+		writeError(w, http.StatusServiceUnavailable, pool.ErrUnavailable)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	writeJSON(w, http.StatusOK, workPool.List())
+}
+
+// taskHandler serves workers: POST lease hands out a task, and POST
+// {id}/heartbeat, {id}/result and {id}/release update a leased one.
+func taskHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(w, r) {
+		return
+	}
+	if workPool == nil {
+		writeError(w, http.StatusServiceUnavailable, pool.ErrUnavailable)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	var update pool.Update
+	err := json.NewDecoder(r.Body).Decode(&update)
+	if err != nil || update.Worker == "" {
+		writeError(w, http.StatusBadRequest, errors.New("a worker is required"))
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/drift-detector/api/tasks/")
+	if path == "lease" {
+		ctx, cancel := context.WithTimeout(r.Context(), leaseWait)
+		defer cancel()
+		task, err := workPool.Lease(ctx, update.Worker)
+		switch {
+		case err != nil:
+			writeError(w, http.StatusServiceUnavailable, err)
+		case task == nil:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeJSON(w, http.StatusOK, task)
+		}
+		return
+	}
+
+	escapedID, action, _ := strings.Cut(path, "/")
+	id, err := url.PathUnescape(escapedID)
+	if err != nil || id == "" {
+		writeError(w, http.StatusNotFound, errors.New("task not found"))
+		return
+	}
+	switch action {
+	case "heartbeat":
+		err = workPool.Heartbeat(id, update.Worker)
+	case "result":
+		var planErr error
+		if update.Error != "" {
+			planErr = errors.New(update.Error)
+		}
+		err = workPool.Complete(id, update.Worker, update.Results, planErr)
+	case "release":
+		err = workPool.Release(id, update.Worker)
+	default:
+		writeError(w, http.StatusNotFound, errors.New("unknown task action"))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
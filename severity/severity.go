@@ -0,0 +1,177 @@
+package severity
+
+import (
+	"atlantis-drift-detector/plan"
+	"atlantis-drift-detector/report"
+	"fmt"
+	"os"
+	"path"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Severity levels, from least to most severe.
+const (
+	Low      = "low"
+	Medium   = "medium"
+	High     = "high"
+	Critical = "critical"
+)
+
+var levels = map[string]int{"": 0, Low: 1, Medium: 2, High: 3, Critical: 4}
+
+// Rank orders severities, higher is more severe. Unknown values rank lowest.
+func Rank(severity string) int {
+	return levels[severity]
+}
+
+// Valid reports whether severity is one of the known levels.
+func Valid(severity string) bool {
+	_, ok := levels[severity]
+	return ok && severity != ""
+}
+
+// Max returns the more severe of a and b.
+func Max(a, b string) string {
+	if Rank(b) > Rank(a) {
+		return b
+	}
+	return a
+}
+
+// AtLeast reports whether severity reaches min. An empty min is always
+// reached.
+func AtLeast(severity, min string) bool {
+	return Rank(severity) >= Rank(min)
+}
+
+// Rule assigns Severity to resource changes matching all of its conditions.
+type Rule struct {
+	// Actions matches changes performing any of these actions, e.g. delete.
+	Actions []string `yaml:"actions"`
+	// Types are globs over resource types, e.g. aws_iam_*.
+	Types []string `yaml:"types"`
+	// OnlyAttributes matches changes touching nothing but these attribute
+	// paths, e.g. tags.*.
+	OnlyAttributes []string `yaml:"only_attributes"`
+	Severity       string   `yaml:"severity"`
+}
+
+type Rules struct {
+	// Default applies to changes no rule matches.
+	Default string `yaml:"default"`
+	Rules   []Rule `yaml:"rules"`
+}
+
+var sensitiveTypes = []string{
+	"aws_iam_*", "aws_security_group*", "aws_vpc_security_group_*", "aws_kms_*",
+	"google_*_iam_*", "google_kms_*", "google_compute_firewall",
+	"azurerm_role_*", "azurerm_network_security_*", "azurerm_key_vault*",
+}
+
+// DefaultRules escalate deletes, replaces and any change to access control,
+// network security or encryption resources, and keep tag-only changes low.
+var DefaultRules = &Rules{
+	Default: Medium,
+	Rules: []Rule{
+		{Actions: []string{"delete"}, Types: sensitiveTypes, Severity: Critical},
+		{Actions: []string{"delete"}, Severity: High},
+		{Types: sensitiveTypes, Severity: High},
+		{OnlyAttributes: []string{"tags", "tags_all", "labels"}, Severity: Low},
+		{Actions: []string{"create"}, Severity: Low},
+	},
+}
+
+// Load reads severity rules from file, falling back to DefaultRules when
+// file is empty.
+func Load(file string) (*Rules, error) {
+	if file == "" {
+		return DefaultRules, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	rules := &Rules{Default: Medium}
+	err = yaml.UnmarshalStrict(data, rules)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", file, err)
+	}
+
+	if !Valid(rules.Default) {
+		return nil, fmt.Errorf("%s: invalid default severity %q", file, rules.Default)
+	}
+	for i, rule := range rules.Rules {
+		if !Valid(rule.Severity) {
+			return nil, fmt.Errorf("%s: rule %d has invalid severity %q", file, i+1, rule.Severity)
+		}
+	}
+	return rules, nil
+}
+
+// Score returns the severity of a drifted project, the highest severity of
+// any of its changes. Rules are evaluated in order and the first match wins.
+func (r *Rules) Score(changes []report.Change) string {
+	var score string
+	for _, change := range changes {
+		score = Max(score, r.scoreChange(change))
+	}
+	return score
+}
+
+func (r *Rules) scoreChange(change report.Change) string {
+	for _, rule := range r.Rules {
+		if rule.matches(change) {
+			return rule.Severity
+		}
+	}
+	return r.Default
+}
+
+func (rule *Rule) matches(change report.Change) bool {
+	if len(rule.Actions) > 0 && !anyAction(rule.Actions, change.Actions) {
+		return false
+	}
+	if len(rule.Types) > 0 && !anyGlob(rule.Types, change.Type) {
+		return false
+	}
+	if len(rule.OnlyAttributes) > 0 {
+		if len(change.Attributes) == 0 {
+			return false
+		}
+		for _, attribute := range change.Attributes {
+			covered := false
+			for _, pattern := range rule.OnlyAttributes {
+				if plan.MatchAttribute(pattern, attribute) {
+					covered = true
+					break
+				}
+			}
+			if !covered {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func anyAction(wanted, actions []string) bool {
+	for _, w := range wanted {
+		for _, action := range actions {
+			if w == action {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func anyGlob(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
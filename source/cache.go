@@ -0,0 +1,246 @@
+package source
+
+import (
+	"atlantis-drift-detector/flock"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4"
+	gitconfig "gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+// cacheOptions controls the persistent clone cache, see UseCache.
+var cacheOptions struct {
+	dir    string
+	depth  int
+	branch string
+}
+
+// cacheLocks serialise access to each cached clone within the detector,
+// the file locks next to them across processes sharing the cache.
+var cacheLocks sync.Map
+
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// UseCache keeps clones in dir between runs instead of cloning into a
+// temporary folder every time. Cached clones are fetched and force checked
+// out on each checkout. depth limits the history fetched (0 fetches
+// everything) and branch is the branch scanned for repos without their own
+// ref, the remote default branch when empty. Caching is disabled when dir is
+// empty.
+func UseCache(dir string, depth int, branch string) {
+	cacheOptions.dir = dir
+	cacheOptions.depth = depth
+	cacheOptions.branch = branch
+}
+
+// Workspace is a checked out repository ready to be scanned.
+type Workspace struct {
+	// Dir holds the working tree.
+	Dir string
+	// Commit is the sha of the checked out revision, empty when the source
+	// is not a git repository.
+	Commit  string
+	release func()
+}
+
+// Release hands the workspace back once scanning has finished. Temporary
+// clones are removed and cached clones are unlocked for the next user.
+func (w *Workspace) Release() {
+	if w.release != nil {
+		w.release()
+	}
+}
+
+// cacheDir returns the cache folder for url. The folder name stays readable
+// but is suffixed with a hash so that similarly named repos never collide.
+func cacheDir(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(cacheOptions.dir, unsafeChars.ReplaceAllString(repoName(url), "_")+"-"+hex.EncodeToString(sum[:6]))
+}
+
+func clone(dest, url string, auth transport.AuthMethod, ref Ref) (*Workspace, error) {
+	if ref.Kind == "" && cacheOptions.branch != "" {
+		ref = Ref{Kind: "branch", Name: cacheOptions.branch}
+	}
+
+	if cacheOptions.dir == "" {
+		return cloneTemporary(dest, url, auth, ref)
+	}
+
+	dir := cacheDir(url)
+	unlock := lockCache(dir)
+
+	commit, err := syncCache(dir, url, auth, ref)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+
+	return &Workspace{Dir: dir, Commit: commit, release: unlock}, nil
+}
+
+// lockCache waits until no other checkout, in this process or another one
+// sharing the cache, uses the cached clone in dir, and returns the function
+// releasing it. The lock file sits next to the clone, which may be removed
+// and cloned again while locked.
+func lockCache(dir string) func() {
+	lock, _ := cacheLocks.LoadOrStore(dir, &sync.Mutex{})
+	mu := lock.(*sync.Mutex)
+	mu.Lock()
+
+	err := os.MkdirAll(cacheOptions.dir, 0755)
+	if err != nil {
+		log.Warnf("error creating clone cache %s: %s", cacheOptions.dir, err)
+		return mu.Unlock
+	}
+	file, err := os.OpenFile(dir+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err == nil {
+		err = flock.Lock(file)
+	}
+	if err != nil {
+		log.Warnf("error locking cached clone %s, only locking it within this process: %s", dir, err)
+		if file != nil {
+			file.Close()
+		}
+		return mu.Unlock
+	}
+	return func() {
+		flock.Unlock(file)
+		file.Close()
+		mu.Unlock()
+	}
+}
+
+func cloneTemporary(dest, url string, auth transport.AuthMethod, ref Ref) (*Workspace, error) {
+	remove := func() {
+		err := os.RemoveAll(dest)
+		if err != nil {
+			log.Warnf("error removing directory: %v", err)
+		}
+	}
+
+	opts := &git.CloneOptions{URL: url, Auth: auth, Depth: cacheOptions.depth}
+	switch ref.Kind {
+	case "branch":
+		opts.ReferenceName = plumbing.NewBranchReferenceName(ref.Name)
+		opts.SingleBranch = true
+	case "tag":
+		opts.ReferenceName = plumbing.NewTagReferenceName(ref.Name)
+		opts.SingleBranch = true
+	case "commit":
+		// The commit may be anywhere in the history
+		opts.Depth = 0
+	}
+
+	r, err := git.PlainClone(dest, false, opts)
+	if err != nil {
+		log.Warnf("error cloning repository: %v", err)
+		remove()
+		return nil, err
+	}
+
+	head, err := r.Head()
+	if err != nil {
+		log.Warnf("error verifying repository was cloned correctly: %v", err)
+		remove()
+		return nil, err
+	}
+
+	commit := head.Hash()
+	if ref.Kind == "commit" {
+		commit, err = checkout(r, ref, "")
+		if err != nil {
+			remove()
+			return nil, err
+		}
+	}
+
+	return &Workspace{Dir: dest, Commit: commit.String(), release: remove}, nil
+}
+
+// syncCache brings the cached clone in dir up to date with ref on the
+// remote, cloning it first if it does not exist yet or cannot be opened, and
+// returns the checked out commit.
+func syncCache(dir, url string, auth transport.AuthMethod, ref Ref) (string, error) {
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		log.Infof("populating clone cache for %s", url)
+		if err := os.RemoveAll(dir); err != nil {
+			return "", fmt.Errorf("error removing stale cache directory: %w", err)
+		}
+		r, err = git.PlainInit(dir, false)
+		if err != nil {
+			return "", fmt.Errorf("error initialising cache directory: %w", err)
+		}
+		_, err = r.CreateRemote(&gitconfig.RemoteConfig{Name: "origin", URLs: []string{url}})
+		if err != nil {
+			return "", fmt.Errorf("error adding remote: %w", err)
+		}
+	}
+
+	if ref.Kind == "" {
+		branch, err := defaultBranch(r, &git.ListOptions{Auth: auth})
+		if err != nil {
+			return "", err
+		}
+		ref = Ref{Kind: "branch", Name: branch}
+	}
+	refSpec, name := ref.refSpec()
+
+	log.Debugf("fetching %s of %s into clone cache", ref, url)
+	depth := cacheOptions.depth
+	if ref.Kind == "commit" {
+		depth = 0
+	}
+	err = r.Fetch(&git.FetchOptions{
+		RemoteName: "origin",
+		Auth:       auth,
+		Depth:      depth,
+		Force:      true,
+		Tags:       git.NoTags,
+		RefSpecs:   []gitconfig.RefSpec{gitconfig.RefSpec(refSpec)},
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		log.Warnf("error fetching repository: %v", err)
+		return "", err
+	}
+
+	commit, err := checkout(r, ref, name)
+	if err != nil {
+		return "", err
+	}
+	return commit.String(), nil
+}
+
+// checkout resolves ref and force checks out the commit it points to on a
+// detached HEAD, discarding anything left behind by the previous run.
+func checkout(r *git.Repository, ref Ref, name plumbing.ReferenceName) (plumbing.Hash, error) {
+	commit, err := resolveCommit(r, ref, name)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	w, err := r.Worktree()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	err = w.Checkout(&git.CheckoutOptions{Hash: commit, Force: true})
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("error checking out %s: %w", commit, err)
+	}
+	err = w.Clean(&git.CleanOptions{Dir: true})
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("error cleaning worktree: %w", err)
+	}
+
+	return commit, nil
+}
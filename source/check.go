@@ -0,0 +1,39 @@
+package source
+
+import (
+	"fmt"
+
+	"gopkg.in/src-d/go-git.v4"
+	gitconfig "gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+// checkRemote lists the references of url with auth, which fails on
+// unreachable hosts and bad credentials, and makes sure a branch or tag ref
+// exists. Commits cannot be looked up without fetching, so only the
+// repository is checked for them.
+func checkRemote(url string, auth transport.AuthMethod, ref Ref) error {
+	remote := git.NewRemote(memory.NewStorage(), &gitconfig.RemoteConfig{Name: "origin", URLs: []string{url}})
+	refs, err := remote.List(&git.ListOptions{Auth: auth})
+	if err != nil {
+		return fmt.Errorf("error listing %s: %w", url, err)
+	}
+	var name plumbing.ReferenceName
+	switch ref.Kind {
+	case "branch":
+		name = plumbing.NewBranchReferenceName(ref.Name)
+	case "tag":
+		name = plumbing.NewTagReferenceName(ref.Name)
+	default:
+		return nil
+	}
+
+	for _, r := range refs {
+		if r.Name() == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s not found in %s", ref, url)
+}
@@ -0,0 +1,52 @@
+package source
+
+import (
+	"fmt"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// ChangedFiles lists the paths, relative to the repository root, that differ
+// between commits from and to of the repository checked out in dir. Both
+// commits must be present in the local history.
+func ChangedFiles(dir, from, to string) ([]string, error) {
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := func(sha string) (*object.Tree, error) {
+		commit, err := r.CommitObject(plumbing.NewHash(sha))
+		if err != nil {
+			return nil, fmt.Errorf("error reading commit %s: %w", sha, err)
+		}
+		return commit.Tree()
+	}
+	fromTree, err := tree(from)
+	if err != nil {
+		return nil, err
+	}
+	toTree, err := tree(to)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := object.DiffTree(fromTree, toTree)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, change := range changes {
+		// Renames touch both the old and the new location
+		if change.From.Name != "" {
+			files = append(files, change.From.Name)
+		}
+		if change.To.Name != "" && change.To.Name != change.From.Name {
+			files = append(files, change.To.Name)
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,125 @@
+package source
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+var shaPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// Ref selects the revision of a repository to scan.
+type Ref struct {
+	// Kind is one of branch, tag or commit. An empty Ref follows the
+	// default branch.
+	Kind string
+	Name string
+}
+
+// ParseRef parses kind:name, e.g. branch:release, tag:v1.4.0 or commit:<sha>.
+// Commits must be given as full 40 character shas. Without a kind, such shas
+// are treated as commits and anything else as a branch.
+func ParseRef(value string) (Ref, error) {
+	if value == "" {
+		return Ref{}, nil
+	}
+
+	kind, name, found := strings.Cut(value, ":")
+	if !found {
+		if shaPattern.MatchString(value) {
+			return Ref{Kind: "commit", Name: value}, nil
+		}
+		return Ref{Kind: "branch", Name: value}, nil
+	}
+
+	switch kind {
+	case "branch", "tag":
+	case "commit":
+		if !shaPattern.MatchString(name) {
+			return Ref{}, fmt.Errorf("invalid commit sha %q, expected 40 hex characters", name)
+		}
+	default:
+		return Ref{}, fmt.Errorf("invalid ref kind %q, expected branch, tag or commit", kind)
+	}
+	if name == "" {
+		return Ref{}, fmt.Errorf("empty %s name", kind)
+	}
+
+	return Ref{Kind: kind, Name: name}, nil
+}
+
+func (r Ref) String() string {
+	if r.Kind == "" {
+		return "default branch"
+	}
+	return r.Kind + ":" + r.Name
+}
+
+// refSpec returns the refspec fetching r into the cached clone and the local
+// reference it ends up in. Commits cannot be fetched by sha, so every branch
+// is fetched and the commit is looked up afterwards.
+func (r Ref) refSpec() (string, plumbing.ReferenceName) {
+	switch r.Kind {
+	case "tag":
+		name := plumbing.NewTagReferenceName(r.Name)
+		return fmt.Sprintf("+%s:%s", name, name), name
+	case "commit":
+		return "+refs/heads/*:refs/remotes/origin/*", ""
+	default:
+		name := plumbing.NewRemoteReferenceName("origin", r.Name)
+		return fmt.Sprintf("+refs/heads/%s:%s", r.Name, name), name
+	}
+}
+
+// resolveCommit returns the commit a fetched reference points to, peeling
+// annotated tags.
+func resolveCommit(repo *git.Repository, r Ref, name plumbing.ReferenceName) (plumbing.Hash, error) {
+	if r.Kind == "commit" {
+		commit, err := repo.CommitObject(plumbing.NewHash(r.Name))
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("error resolving commit %s: %w", r.Name, err)
+		}
+		return commit.Hash, nil
+	}
+
+	ref, err := repo.Reference(name, true)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("error resolving %s: %w", name, err)
+	}
+	if tag, err := repo.TagObject(ref.Hash()); err == nil {
+		commit, err := tag.Commit()
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("error peeling tag %s: %w", r.Name, err)
+		}
+		return commit.Hash, nil
+	}
+	return ref.Hash(), nil
+}
+
+// defaultBranch asks the remote which branch its HEAD points to, falling back
+// to the branch currently checked out.
+func defaultBranch(repo *git.Repository, listOpts *git.ListOptions) (string, error) {
+	remote, err := repo.Remote("origin")
+	if err == nil {
+		refs, err := remote.List(listOpts)
+		if err == nil {
+			for _, ref := range refs {
+				if ref.Name() == plumbing.HEAD && ref.Type() == plumbing.SymbolicReference {
+					return ref.Target().Short(), nil
+				}
+			}
+		}
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return "", fmt.Errorf("error reading HEAD: %w", err)
+	}
+	if !head.Name().IsBranch() {
+		return "", fmt.Errorf("cannot determine the default branch, HEAD is detached")
+	}
+	return head.Name().Short(), nil
+}
@@ -0,0 +1,372 @@
+package source
+
+import (
+	"atlantis-drift-detector/ghapp"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
+	httpauth "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+)
+
+// Source is a repository the detector can scan.
+type Source interface {
+	// Name is the folder name the repository is reported under.
+	Name() string
+	// Checkout makes the repository available, cloning it into dest unless
+	// a clone cache is in use, or copying it when on disk. The returned
+	// workspace must be released once scanning has finished.
+	Checkout(dest string) (*Workspace, error)
+	// Check verifies that the repository and its ref can be reached with
+	// the configured credentials, without cloning it.
+	Check() error
+}
+
+// Credentials holds everything the different source kinds need to
+// authenticate. Unused fields may be left empty.
+type Credentials struct {
+	GitHubTokens        *ghapp.TokenProvider
+	GitHubInstallations ghapp.Installations
+	GitHubEndpoints     ghapp.Endpoints
+
+	// GitLabTokens maps host or host/group prefixes to project or group
+	// access tokens; the longest matching prefix wins.
+	GitLabTokens map[string]string
+
+	BitbucketUsername    string
+	BitbucketAppPassword string
+
+	SSHKeyFile string
+}
+
+// UseHTTPClient makes git operations over HTTPS use the transport of
+// httpClient, e.g. to trust a custom CA bundle. Clones are long running, so
+// the client's timeout is not carried over.
+func UseHTTPClient(httpClient *http.Client) {
+	client.InstallProtocol("https", httpauth.NewClient(&http.Client{Transport: httpClient.Transport}))
+}
+
+// Parse turns an allowlist entry into a Source. Entries take the form
+// [kind:]location[#ref], where kind is one of github (the default), gitlab,
+// bitbucket, ssh or local and ref is parsed by ParseRef:
+//
+//	github.com/org/repo
+//	github.com/org/repo#branch:release
+//	gitlab:gitlab.com/group/subgroup/project#tag:v1.4.0
+//	bitbucket:bitbucket.org/workspace/repo
+//	ssh:git@git.example.com:org/repo.git
+//	local:/srv/infra
+func Parse(entry string, creds *Credentials) (Source, error) {
+	entry = strings.TrimSpace(entry)
+	entry, refValue, _ := strings.Cut(entry, "#")
+	ref, err := ParseRef(refValue)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ref in allowlist entry %q: %w", entry, err)
+	}
+
+	kind, location, found := strings.Cut(entry, ":")
+	if !found || !isKind(kind) {
+		kind, location = "github", entry
+	}
+	if location == "" {
+		return nil, fmt.Errorf("empty repository in allowlist entry %q", entry)
+	}
+
+	switch kind {
+	case "github":
+		parts := strings.Split(location, "/")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid github repository %q, expected host/org/repo", location)
+		}
+		return &gitHubSource{host: parts[0], org: parts[1], repo: parts[2], ref: ref, creds: creds}, nil
+	case "gitlab":
+		if strings.Count(location, "/") < 2 {
+			return nil, fmt.Errorf("invalid gitlab project %q, expected host/group/project", location)
+		}
+		return &gitLabSource{location: location, ref: ref, creds: creds}, nil
+	case "bitbucket":
+		if strings.Count(location, "/") != 2 {
+			return nil, fmt.Errorf("invalid bitbucket repository %q, expected host/workspace/repo", location)
+		}
+		return &bitbucketSource{location: location, ref: ref, creds: creds}, nil
+	case "ssh":
+		return &sshSource{url: location, ref: ref, creds: creds}, nil
+	default:
+		if ref.Kind != "" {
+			return nil, fmt.Errorf("local repository %q cannot select a ref", location)
+		}
+		return &localSource{path: location}, nil
+	}
+}
+
+func isKind(kind string) bool {
+	switch kind {
+	case "github", "gitlab", "bitbucket", "ssh", "local":
+		return true
+	}
+	return false
+}
+
+// repoName returns the last element of a repository location without a
+// trailing .git.
+func repoName(location string) string {
+	location = strings.TrimSuffix(strings.TrimSuffix(location, "/"), ".git")
+	if i := strings.LastIndexAny(location, "/:"); i >= 0 {
+		location = location[i+1:]
+	}
+	return location
+}
+
+type gitHubSource struct {
+	host, org, repo string
+	ref             Ref
+	creds           *Credentials
+}
+
+func (s *gitHubSource) Name() string { return s.repo }
+
+func (s *gitHubSource) Checkout(dest string) (*Workspace, error) {
+	var workspace *Workspace
+	err := s.withAuth(func(auth transport.AuthMethod) error {
+		var err error
+		workspace, err = clone(dest, s.creds.GitHubEndpoints.CloneURL(s.host, s.org, s.repo), auth, s.ref)
+		return err
+	})
+	return workspace, err
+}
+
+func (s *gitHubSource) Check() error {
+	return s.withAuth(func(auth transport.AuthMethod) error {
+		return checkRemote(s.creds.GitHubEndpoints.CloneURL(s.host, s.org, s.repo), auth, s.ref)
+	})
+}
+
+// withAuth runs fn with an installation token. A token GitHub rejects, e.g.
+// because it was revoked, is dropped and fn retried once with a new one.
+func (s *gitHubSource) withAuth(fn func(transport.AuthMethod) error) error {
+	installationId, err := s.creds.GitHubInstallations.For(s.host, s.org)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		auth, err := s.auth(installationId)
+		if err != nil {
+			return err
+		}
+		err = fn(auth)
+		if attempt > 1 || !isAuthError(err) {
+			return err
+		}
+		log.Warnf("github rejected the installation token for %s/%s, requesting a new one: %v", s.org, s.repo, err)
+		s.creds.GitHubTokens.Invalidate(s.host, installationId)
+	}
+}
+
+func (s *gitHubSource) auth(installationId string) (transport.AuthMethod, error) {
+	token, err := s.creds.GitHubTokens.Token(s.host, installationId)
+	if err != nil {
+		log.Warnf("error getting installation token: %v", err)
+		return nil, err
+	}
+
+	return &httpauth.BasicAuth{
+		Username: "x-access-token", // Yes, this can be anything except an empty string.
+		Password: token,
+	}, nil
+}
+
+// isAuthError reports whether err is the remote rejecting credentials.
+func isAuthError(err error) bool {
+	return errors.Is(err, transport.ErrAuthenticationRequired) || errors.Is(err, transport.ErrAuthorizationFailed)
+}
+
+type gitLabSource struct {
+	location string
+	ref      Ref
+	creds    *Credentials
+}
+
+func (s *gitLabSource) Name() string { return repoName(s.location) }
+
+func (s *gitLabSource) Checkout(dest string) (*Workspace, error) {
+	return clone(dest, "https://"+s.location+".git", s.auth(), s.ref)
+}
+
+func (s *gitLabSource) Check() error {
+	return checkRemote("https://"+s.location+".git", s.auth(), s.ref)
+}
+
+func (s *gitLabSource) auth() transport.AuthMethod {
+	if token := s.token(); token != "" {
+		// GitLab accepts any non-empty username together with an access token.
+		return &httpauth.BasicAuth{Username: "oauth2", Password: token}
+	}
+	return nil
+}
+
+func (s *gitLabSource) token() string {
+	var token string
+	var longest int
+	for prefix, t := range s.creds.GitLabTokens {
+		if (s.location == prefix || strings.HasPrefix(s.location, prefix+"/")) && len(prefix) > longest {
+			token, longest = t, len(prefix)
+		}
+	}
+	return token
+}
+
+type bitbucketSource struct {
+	location string
+	ref      Ref
+	creds    *Credentials
+}
+
+func (s *bitbucketSource) Name() string { return repoName(s.location) }
+
+func (s *bitbucketSource) Checkout(dest string) (*Workspace, error) {
+	return clone(dest, "https://"+s.location+".git", s.auth(), s.ref)
+}
+
+func (s *bitbucketSource) Check() error {
+	return checkRemote("https://"+s.location+".git", s.auth(), s.ref)
+}
+
+func (s *bitbucketSource) auth() transport.AuthMethod {
+	if s.creds.BitbucketUsername != "" {
+		return &httpauth.BasicAuth{Username: s.creds.BitbucketUsername, Password: s.creds.BitbucketAppPassword}
+	}
+	return nil
+}
+
+type sshSource struct {
+	url   string
+	ref   Ref
+	creds *Credentials
+}
+
+func (s *sshSource) Name() string { return repoName(s.url) }
+
+func (s *sshSource) Checkout(dest string) (*Workspace, error) {
+	auth, err := sshAuth(s.url, s.creds.SSHKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return clone(dest, s.url, auth, s.ref)
+}
+
+func (s *sshSource) Check() error {
+	auth, err := sshAuth(s.url, s.creds.SSHKeyFile)
+	if err != nil {
+		return err
+	}
+	return checkRemote(s.url, auth, s.ref)
+}
+
+type localSource struct {
+	path string
+}
+
+func (s *localSource) Name() string { return filepath.Base(filepath.Clean(s.path)) }
+
+// Checkout copies the local path into a temporary folder rather than dest,
+// which may be the path itself, so that plans never write plan files or
+// caches into it nor clean them up. The copy is removed on release.
+func (s *localSource) Checkout(dest string) (*Workspace, error) {
+	dir, err := os.MkdirTemp("", "local-"+s.Name()+"-")
+	if err != nil {
+		return nil, err
+	}
+	remove := func() {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			log.Warnf("error removing directory: %v", err)
+		}
+	}
+
+	err = copyTree(s.path, dir)
+	if err != nil {
+		remove()
+		return nil, fmt.Errorf("error copying %s: %w", s.path, err)
+	}
+
+	workspace := &Workspace{Dir: dir, release: remove}
+	if r, err := git.PlainOpen(s.path); err == nil {
+		if head, err := r.Head(); err == nil {
+			workspace.Commit = head.Hash().String()
+		}
+	}
+	return workspace, nil
+}
+
+// copyTree copies the folder src to dest, keeping modes and symlinks. The
+// working directories of plans run in src are left out.
+func copyTree(src, dest string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case entry.IsDir() && rel != "." && (entry.Name() == ".terraform" || entry.Name() == ".terragrunt-cache"):
+			return filepath.SkipDir
+		case entry.IsDir() && path == dest:
+			// The copy is inside src
+			return filepath.SkipDir
+		case entry.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case entry.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case !entry.Type().IsRegular():
+			return nil
+		}
+
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, in)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	})
+}
+
+func (s *localSource) Check() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", s.path)
+	}
+	return nil
+}
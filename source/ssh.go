@@ -0,0 +1,28 @@
+package source
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	gitssh "gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+)
+
+// sshAuth loads the private key used for ssh sources. The ssh user is taken
+// from the URL and defaults to git.
+func sshAuth(url, keyFile string) (transport.AuthMethod, error) {
+	if keyFile == "" {
+		return nil, fmt.Errorf("ssh key file not set for %s", url)
+	}
+
+	user := "git"
+	if at := strings.Index(url, "@"); at > 0 {
+		user = strings.TrimPrefix(url[:at], "ssh://")
+	}
+
+	auth, err := gitssh.NewPublicKeysFromFile(user, keyFile, "")
+	if err != nil {
+		return nil, fmt.Errorf("error loading ssh key: %w", err)
+	}
+	return auth, nil
+}
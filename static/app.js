@@ -7,19 +7,21 @@ const ctx = document.getElementById('myChart').getContext('2d');
 let myChart = new Chart(ctx, {
     type: 'bar',
     data: {
-        labels: ['Errors', 'Drifted', 'No changes'],
+        labels: ['Errors', 'Drifted', 'No changes', 'Blocked'],
         datasets: [{
             // Removing the label field from here
-            data: [errorCount, driftedCount, noChangesCount],
+            data: [errorCount, driftedCount, noChangesCount, blockedCount],
             backgroundColor: [
                 'rgba(255, 99, 132, 0.2)',
                 'rgba(255, 204, 0, 0.2)',
-                'rgba(75, 192, 192, 0.2)'
+                'rgba(75, 192, 192, 0.2)',
+                'rgba(108, 117, 125, 0.2)'
             ],
             borderColor: [
                 'rgba(255, 99, 132, 1)',
                 'rgba(255, 204, 0, 1)',
-                'rgba(75, 192, 192, 1)'
+                'rgba(75, 192, 192, 1)',
+                'rgba(108, 117, 125, 1)'
             ],
             borderWidth: 1
         }]
@@ -0,0 +1,170 @@
+package versions
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Version is a semantic version such as 1.5.6 or 1.6.0-beta1.
+type Version struct {
+	Major, Minor, Patch int
+	Pre                 string
+}
+
+var versionPattern = regexp.MustCompile(`^v?(\d+)(?:\.(\d+))?(?:\.(\d+))?(?:-([0-9A-Za-z.-]+))?$`)
+
+// Parse parses a version, missing minor and patch numbers are zero.
+func Parse(s string) (Version, error) {
+	match := versionPattern.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil {
+		return Version{}, fmt.Errorf("invalid version %q", s)
+	}
+	var v Version
+	v.Major, _ = strconv.Atoi(match[1])
+	v.Minor, _ = strconv.Atoi(match[2])
+	v.Patch, _ = strconv.Atoi(match[3])
+	v.Pre = match[4]
+	return v, nil
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Pre != "" {
+		s += "-" + v.Pre
+	}
+	return s
+}
+
+// Compare returns -1, 0 or 1 when v is lower than, equal to or higher than
+// o. Pre-releases are lower than their release.
+func (v Version) Compare(o Version) int {
+	for _, d := range []int{v.Major - o.Major, v.Minor - o.Minor, v.Patch - o.Patch} {
+		switch {
+		case d < 0:
+			return -1
+		case d > 0:
+			return 1
+		}
+	}
+	switch {
+	case v.Pre == o.Pre:
+		return 0
+	case v.Pre == "":
+		return 1
+	case o.Pre == "":
+		return -1
+	case v.Pre < o.Pre:
+		return -1
+	}
+	return 1
+}
+
+// constraint is a single operator and version, e.g. ~> 1.5.
+type constraint struct {
+	op      string
+	version Version
+	// parts is how many of major, minor and patch were given, which ~>
+	// depends on.
+	parts int
+}
+
+// Constraints is a comma separated list of constraints a version must all
+// satisfy, in Terraform's syntax: =, !=, >, >=, <, <= and ~>.
+type Constraints []constraint
+
+var constraintPattern = regexp.MustCompile(`^(=|!=|>=|<=|>|<|~>)?\s*(v?\d+(?:\.\d+){0,2}(?:-[0-9A-Za-z.-]+)?)$`)
+
+// ParseConstraints parses constraints such as ">= 1.3, < 2.0". A plain
+// version is an exact constraint.
+func ParseConstraints(s string) (Constraints, error) {
+	var constraints Constraints
+	for _, part := range strings.Split(s, ",") {
+		match := constraintPattern.FindStringSubmatch(strings.TrimSpace(part))
+		if match == nil {
+			return nil, fmt.Errorf("invalid version constraint %q", strings.TrimSpace(part))
+		}
+		version, err := Parse(match[2])
+		if err != nil {
+			return nil, err
+		}
+		op := match[1]
+		if op == "" {
+			op = "="
+		}
+		parts := strings.Count(strings.SplitN(match[2], "-", 2)[0], ".") + 1
+		constraints = append(constraints, constraint{op: op, version: version, parts: parts})
+	}
+	return constraints, nil
+}
+
+// Check reports whether v satisfies every constraint. Pre-releases only
+// satisfy constraints that name them exactly.
+func (c Constraints) Check(v Version) bool {
+	for _, constraint := range c {
+		if v.Pre != "" && (constraint.op != "=" || constraint.version.Pre == "") {
+			return false
+		}
+		if !constraint.check(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c constraint) check(v Version) bool {
+	cmp := v.Compare(c.version)
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	// ~> allows only the rightmost given part to grow: ~> 1.5 matches any
+	// 1.x from 1.5, ~> 1.5.2 any 1.5.x from 1.5.2
+	if cmp < 0 || v.Major != c.version.Major {
+		return false
+	}
+	return c.parts < 3 || v.Minor == c.version.Minor
+}
+
+// Installed lists the versions of tool installed in dir, which holds every
+// version in its own folder: dir/tool/<version>/tool. The highest version
+// comes first.
+func Installed(dir, tool string) []Version {
+	entries, err := os.ReadDir(filepath.Join(dir, tool))
+	if err != nil {
+		return nil
+	}
+	var installed []Version
+	for _, entry := range entries {
+		version, err := Parse(entry.Name())
+		if err != nil || entry.Name() != version.String() {
+			continue
+		}
+		if _, err := os.Stat(Path(dir, tool, version)); err == nil {
+			installed = append(installed, version)
+		}
+	}
+	sort.Slice(installed, func(i, j int) bool {
+		return installed[i].Compare(installed[j]) > 0
+	})
+	return installed
+}
+
+// Path returns where version of tool is installed in dir.
+func Path(dir, tool string, version Version) string {
+	return filepath.Join(dir, tool, version.String(), tool)
+}
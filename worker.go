@@ -0,0 +1,96 @@
+package main
+
+import (
+	"atlantis-drift-detector/config"
+	"atlantis-drift-detector/drift"
+	"atlantis-drift-detector/pool"
+	"atlantis-drift-detector/report"
+	"atlantis-drift-detector/source"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// work runs a worker, planning tasks leased from the coordinator until it
+// is terminated.
+func work(args []string) int {
+	log.SetFormatter(&log.JSONFormatter{})
+
+	fs, configFile := flags("worker")
+	coordinatorURL := fs.String("coordinator", "", "url of the coordinator, executor.pool.coordinator by default")
+	hostname, _ := os.Hostname()
+	identity := fs.String("identity", hostname, "name the worker leases tasks under")
+	slots := fs.Int("slots", 0, "tasks planned at the same time, the config's concurrency by default")
+	fs.Parse(args)
+
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading config: %s\n", err)
+		return exitFailure
+	}
+	if *coordinatorURL == "" {
+		*coordinatorURL = cfg.Executor.Pool.Coordinator
+	}
+	if *coordinatorURL == "" {
+		fmt.Fprintln(os.Stderr, "worker: --coordinator or executor.pool.coordinator is required")
+		return exitFailure
+	}
+	if *slots < 1 {
+		*slots = cfg.Concurrency
+	}
+	// Workers plan tasks themselves
+	cfg.Executor.Mode = "local"
+	cfg.Concurrency = *slots
+
+	rt, err := prepare(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	rt.apply()
+
+	// Tasks in progress are released on termination, so another worker
+	// picks them up
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Infof("worker %s leasing tasks from %s, %d at a time", *identity, *coordinatorURL, *slots)
+	client := pool.NewClient(*coordinatorURL, cfg.APIToken, rt.httpClient)
+	pool.Work(ctx, client, *identity, *slots, rt.planTask)
+	log.Infof("worker %s stopped", *identity)
+	return exitOK
+}
+
+// planTask plans the projects of a task leased from the coordinator, at the
+// commit the coordinator scanned.
+func (rt *runtime) planTask(ctx context.Context, task pool.Task) ([]report.Result, error) {
+	for _, repo := range rt.repos() {
+		if repo.Config.URL != task.Repo {
+			continue
+		}
+		if task.Commit != "" {
+			entry, _, _ := strings.Cut(repo.Config.URL, "#")
+			src, err := source.Parse(entry+"#commit:"+task.Commit, rt.creds)
+			if err != nil {
+				return nil, err
+			}
+			repo.Source = src
+		}
+		repo.Projects = task.Projects
+		// Tasks of the same repo are cloned side by side
+		repo.Dest = filepath.Join(os.TempDir(), "drift-detector-task-"+task.ID)
+
+		reports, err := drift.DetectDrift(ctx, []drift.Repo{repo})
+		if err != nil {
+			return nil, err
+		}
+		return reports[0].Results, nil
+	}
+	return nil, fmt.Errorf("repo %s is not configured on this worker", task.Repo)
+}